@@ -8,6 +8,7 @@ type pool struct {
 	V4ID       v4api.PoolIdentity
 	PrivateURL string `json:"-"`
 	IsExternal bool   `json:"-"`
+	BatchSize  int    `json:"-"`
 	Sequence   int    `json:"-"`
 }
 
@@ -22,29 +23,45 @@ type poolSort struct {
 	Sort   v4api.SortOrder `json:"sort"`
 }
 
+// globalFilter is a filter value keyed by a merged filter ID from /api/filters. It
+// applies to every pool whose source supports the filter
+type globalFilter struct {
+	FacetID string `json:"facet_id"`
+	Value   string `json:"value"`
+}
+
 type clientSearchRequest struct {
 	v4api.SearchRequest
-	PoolSort []poolSort `json:"pool_sorting"`
+	PoolSort      []poolSort     `json:"pool_sorting"`
+	Blended       bool           `json:"blended,omitempty"`
+	GlobalFilters []globalFilter `json:"global_filters,omitempty"`
+	NoRewrite     bool           `json:"no_rewrite,omitempty"`
 }
 
 // MasterResponse is the search-ws response to a search request. It is different from the
 // API SearchResponse in that it includes modified client request that includes an array of
-// pool sort options
+// pool sort options. When a blended search is requested, it also includes a single relevance
+// ordered hit list across all pools. The query sent to the pools and any suggestions from the
+// query rewrite are also included
 type MasterResponse struct {
 	Request     *clientSearchRequest `json:"request"`
+	Rewrite     *queryRewriteResult  `json:"query_rewrite"`
+	Suggestions []v4api.Suggestion   `json:"suggestions"`
 	Pools       []v4api.PoolIdentity `json:"pools"`
 	TotalTimeMS int64                `json:"total_time_ms"`
 	TotalHits   int                  `json:"total_hits"`
 	Results     []*v4api.PoolResult  `json:"pool_results"`
 	Warnings    []string             `json:"warnings"`
+	Blended     *blendedResult       `json:"blended_results,omitempty"`
 }
 
 // NewSearchResponse creates a new instance of a search response
 func NewSearchResponse(req *clientSearchRequest) *MasterResponse {
 	return &MasterResponse{Request: req,
-		Pools:    make([]v4api.PoolIdentity, 0),
-		Results:  make([]*v4api.PoolResult, 0),
-		Warnings: make([]string, 0),
+		Pools:       make([]v4api.PoolIdentity, 0),
+		Results:     make([]*v4api.PoolResult, 0),
+		Warnings:    make([]string, 0),
+		Suggestions: make([]v4api.Suggestion, 0),
 	}
 }
 
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"slices"
+
+	"golang.org/x/text/unicode/bidi"
+)
+
+// bracketPairs are the paired brackets that resolve to the direction of the text they enclose
+var bracketPairs = map[rune]rune{'(': ')', '[': ']', '{': '}'}
+
+// bidiLevels returns the embedding level of each character of a line with the given paragraph
+// level (0 for left-to-right, 1 for right-to-left). It follows the implicit rules of the
+// Unicode bidirectional algorithm (UAX #9): weak types (W1-W7), paired brackets (N0), neutrals
+// (N1-N2), implicit levels (I1-I2) and trailing whitespace (L1). Explicit embeddings, overrides
+// and isolates are not supported; their formatting characters are treated as neutrals
+func bidiLevels(runes []rune, paraLevel int) []int {
+	n := len(runes)
+	types := make([]bidi.Class, n)
+	original := make([]bidi.Class, n)
+	for i, r := range runes {
+		props, _ := bidi.LookupRune(r)
+		types[i] = props.Class()
+		if types[i] >= bidi.Control || types[i] == bidi.BN {
+			types[i] = bidi.ON
+		}
+		original[i] = types[i]
+	}
+	sos := bidi.L
+	if paraLevel%2 == 1 {
+		sos = bidi.R
+	}
+
+	// W1: non-spacing marks take the type of the previous character
+	for i := range types {
+		if types[i] == bidi.NSM {
+			types[i] = sos
+			if i > 0 {
+				types[i] = types[i-1]
+			}
+		}
+	}
+	// W2: European numbers after an Arabic letter are Arabic numbers; W3: Arabic letters are R
+	lastStrong := sos
+	for i, t := range types {
+		switch t {
+		case bidi.L, bidi.R, bidi.AL:
+			lastStrong = t
+		case bidi.EN:
+			if lastStrong == bidi.AL {
+				types[i] = bidi.AN
+			}
+		}
+	}
+	for i, t := range types {
+		if t == bidi.AL {
+			types[i] = bidi.R
+		}
+	}
+	// W4: a single separator between two numbers of the same type joins them
+	for i := 1; i < n-1; i++ {
+		prev, next := types[i-1], types[i+1]
+		if types[i] == bidi.ES && prev == bidi.EN && next == bidi.EN {
+			types[i] = bidi.EN
+		} else if types[i] == bidi.CS && prev == next && (prev == bidi.EN || prev == bidi.AN) {
+			types[i] = prev
+		}
+	}
+	// W5: terminators next to European numbers are European numbers
+	for i := 0; i < n; i++ {
+		if types[i] != bidi.ET {
+			continue
+		}
+		end := i
+		for end < n && types[end] == bidi.ET {
+			end++
+		}
+		if (i > 0 && types[i-1] == bidi.EN) || (end < n && types[end] == bidi.EN) {
+			for j := i; j < end; j++ {
+				types[j] = bidi.EN
+			}
+		}
+		i = end - 1
+	}
+	// W6: remaining separators and terminators are neutral
+	for i, t := range types {
+		if t == bidi.ES || t == bidi.ET || t == bidi.CS {
+			types[i] = bidi.ON
+		}
+	}
+	// W7: European numbers after left-to-right text are left-to-right
+	lastStrong = sos
+	for i, t := range types {
+		switch t {
+		case bidi.L, bidi.R:
+			lastStrong = t
+		case bidi.EN:
+			if lastStrong == bidi.L {
+				types[i] = bidi.L
+			}
+		}
+	}
+
+	// strong direction of a resolved type; numbers count as right-to-left for neutrals
+	strong := func(t bidi.Class) bidi.Class {
+		switch t {
+		case bidi.L:
+			return bidi.L
+		case bidi.R, bidi.EN, bidi.AN:
+			return bidi.R
+		}
+		return bidi.ON
+	}
+
+	// N0: paired brackets take the embedding direction if the text they enclose has it, or
+	// the opposite direction if the enclosed and preceding text both have that direction
+	type bracketPair struct{ open, close int }
+	pairs := make([]bracketPair, 0)
+	stack := make([]int, 0)
+	for i, r := range runes {
+		if types[i] != bidi.ON {
+			continue
+		}
+		if _, ok := bracketPairs[r]; ok {
+			stack = append(stack, i)
+			continue
+		}
+		for s := len(stack) - 1; s >= 0; s-- {
+			if bracketPairs[runes[stack[s]]] == r {
+				pairs = append(pairs, bracketPair{open: stack[s], close: i})
+				stack = stack[:s]
+				break
+			}
+		}
+	}
+	slices.SortFunc(pairs, func(a, b bracketPair) int { return a.open - b.open })
+	for _, pair := range pairs {
+		found := bidi.ON
+		for i := pair.open + 1; i < pair.close; i++ {
+			if dir := strong(types[i]); dir == sos {
+				found = sos
+				break
+			} else if dir != bidi.ON {
+				found = dir
+			}
+		}
+		if found == bidi.ON {
+			continue
+		}
+		if found != sos {
+			preceding := sos
+			for i := pair.open - 1; i >= 0; i-- {
+				if dir := strong(types[i]); dir != bidi.ON {
+					preceding = dir
+					break
+				}
+			}
+			if preceding != found {
+				found = sos
+			}
+		}
+		types[pair.open], types[pair.close] = found, found
+		// marks on the brackets follow them
+		for _, idx := range []int{pair.open, pair.close} {
+			for i := idx + 1; i < n && original[i] == bidi.NSM; i++ {
+				types[i] = found
+			}
+		}
+	}
+
+	// N1, N2: neutrals take the direction of the text on both sides if it is the same, and
+	// the embedding direction otherwise
+	for i := 0; i < n; i++ {
+		if strong(types[i]) != bidi.ON {
+			continue
+		}
+		end := i
+		for end < n && strong(types[end]) == bidi.ON {
+			end++
+		}
+		before, after := sos, sos
+		if i > 0 {
+			before = strong(types[i-1])
+		}
+		if end < n {
+			after = strong(types[end])
+		}
+		dir := sos
+		if before == after {
+			dir = before
+		}
+		for j := i; j < end; j++ {
+			types[j] = dir
+		}
+		i = end - 1
+	}
+
+	// I1, I2: implicit levels
+	levels := make([]int, n)
+	for i, t := range types {
+		levels[i] = paraLevel
+		switch {
+		case paraLevel%2 == 0 && t == bidi.R:
+			levels[i]++
+		case paraLevel%2 == 0 && (t == bidi.EN || t == bidi.AN):
+			levels[i] += 2
+		case paraLevel%2 == 1 && t != bidi.R:
+			levels[i]++
+		}
+	}
+
+	// L1: segment separators and trailing whitespace are at the paragraph level
+	trailing := true
+	for i := n - 1; i >= 0; i-- {
+		switch original[i] {
+		case bidi.S, bidi.B:
+			levels[i] = paraLevel
+			trailing = true
+		case bidi.WS:
+			if trailing {
+				levels[i] = paraLevel
+			}
+		default:
+			trailing = false
+		}
+	}
+	return levels
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/uvalib/virgo4-api/v4api"
+)
+
+// maxBlendedDepth is the deepest hit that can be requested in blended mode. Every pool
+// must return all hits up to the end of the requested page, so this keeps the pool load sane
+const maxBlendedDepth = 1000
+
+// blendedHit is a single group of results in the blended list along with the pool it came from
+type blendedHit struct {
+	PoolID string      `json:"pool_id"`
+	Score  float64     `json:"score"`
+	Group  v4api.Group `json:"group"`
+	rank   int
+	seq    int
+}
+
+// blendedResult is a single relevance-ordered, paginated hit list across all pools
+type blendedResult struct {
+	Pagination v4api.Pagination `json:"pagination"`
+	Hits       []*blendedHit    `json:"hits"`
+}
+
+// blendedPagination returns the pagination each pool must be sent so that the
+// requested blended page can be built from the merged results
+func blendedPagination(req *clientSearchRequest) v4api.Pagination {
+	return v4api.Pagination{Start: 0, Rows: req.Pagination.Start + req.Pagination.Rows}
+}
+
+// blendResults normalizes the scores of every hit in the successful pool results and
+// merges them into a single list paginated according to the original client request
+func blendResults(req *clientSearchRequest, results []*v4api.PoolResult, pools []*pool) *blendedResult {
+	out := blendedResult{Pagination: req.Pagination, Hits: make([]*blendedHit, 0)}
+	out.Pagination.Total = 0
+
+	hits := make([]*blendedHit, 0)
+	for _, pr := range results {
+		if pr.StatusCode != http.StatusOK {
+			continue
+		}
+		out.Pagination.Total += pr.Pagination.Total
+
+		seq := 0
+		if p := getPool(pools, pr.PoolName); p != nil {
+			seq = p.Sequence
+		}
+
+		maxScore := debugScore(pr.Debug, "max_score")
+		for idx, group := range pr.Groups {
+			hit := blendedHit{PoolID: pr.PoolName, Group: group, rank: idx, seq: seq}
+			hit.Score = normalizedScore(group, idx, len(pr.Groups), maxScore)
+			hits = append(hits, &hit)
+		}
+	}
+
+	// highest score first. Ties go to the higher ranked hit, then the pool sequence
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		if hits[i].rank != hits[j].rank {
+			return hits[i].rank < hits[j].rank
+		}
+		return hits[i].seq < hits[j].seq
+	})
+
+	start := req.Pagination.Start
+	end := start + req.Pagination.Rows
+	if start < len(hits) {
+		if end > len(hits) {
+			end = len(hits)
+		}
+		out.Hits = hits[start:end]
+	}
+
+	log.Printf("INFO: blended %d pool hits into page of %d", len(hits), len(out.Hits))
+	return &out
+}
+
+// normalizedScore returns a 0-1 score for a group. If the pool reported relevance scores
+// they are scaled by the pool max_score. Otherwise a score is derived from the hit rank.
+func normalizedScore(group v4api.Group, rank int, total int, maxScore float64) float64 {
+	if maxScore > 0 && len(group.Records) > 0 {
+		score := debugScore(group.Records[0].Debug, "score")
+		if score > 0 {
+			return score / maxScore
+		}
+	}
+	return 1.0 - float64(rank)/float64(total+1)
+}
+
+// debugScore extracts a numeric score from a pool debug map. Zero if not present
+func debugScore(debug map[string]interface{}, key string) float64 {
+	val, ok := debug[key]
+	if !ok {
+		return 0
+	}
+	switch v := val.(type) {
+	case float64:
+		return v
+	case int:
+		return float64(v)
+	}
+	return 0
+}
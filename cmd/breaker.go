@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	return []string{"closed", "half-open", "open"}[s]
+}
+
+// poolBreaker tracks the failures of a single pool
+type poolBreaker struct {
+	state    breakerState
+	failures int
+	opened   time.Time
+	probing  bool
+}
+
+// breakerSet is a collection of circuit breakers, one per pool ID. A breaker opens after
+// a number of consecutive pool failures and short-circuits all requests to that pool.
+// After a cooldown it half-opens and lets a single probe request through to test recovery.
+type breakerSet struct {
+	lock        sync.Mutex
+	breakers    map[string]*poolBreaker
+	maxFailures int
+	cooldown    time.Duration
+	stateGauge  *prometheus.GaugeVec
+	shortCount  *prometheus.CounterVec
+}
+
+func newBreakerSet(maxFailures int, cooldownSec int) *breakerSet {
+	bs := breakerSet{
+		breakers:    make(map[string]*poolBreaker),
+		maxFailures: maxFailures,
+		cooldown:    time.Duration(cooldownSec) * time.Second,
+		stateGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "v4search_pool_breaker_state",
+			Help: "Pool circuit breaker state: 0=closed, 1=half-open, 2=open",
+		}, []string{"pool"}),
+		shortCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "v4search_pool_breaker_short_circuits_total",
+			Help: "Number of pool requests rejected by an open circuit breaker",
+		}, []string{"pool"}),
+	}
+	prometheus.MustRegister(bs.stateGauge, bs.shortCount)
+	return &bs
+}
+
+// allow returns true if a request to the pool may proceed
+func (bs *breakerSet) allow(poolID string) bool {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	b := bs.getBreaker(poolID)
+
+	if b.state == breakerOpen && time.Since(b.opened) >= bs.cooldown {
+		log.Printf("INFO: circuit breaker for %s is half-open", poolID)
+		bs.setState(poolID, b, breakerHalfOpen)
+	}
+
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerHalfOpen:
+		if b.probing == false {
+			b.probing = true
+			return true
+		}
+	}
+
+	bs.shortCount.WithLabelValues(poolID).Inc()
+	return false
+}
+
+// record tracks the status code of a completed request to the pool
+func (bs *breakerSet) record(poolID string, statusCode int) {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	b := bs.getBreaker(poolID)
+	b.probing = false
+
+	if isPoolFailure(statusCode) == false {
+		if b.state != breakerClosed {
+			log.Printf("INFO: circuit breaker for %s is closed", poolID)
+		}
+		b.failures = 0
+		bs.setState(poolID, b, breakerClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= bs.maxFailures {
+		if b.state != breakerOpen {
+			log.Printf("WARNING: circuit breaker for %s is open after %d failures", poolID, b.failures)
+		}
+		b.opened = time.Now()
+		bs.setState(poolID, b, breakerOpen)
+	}
+}
+
+// cancel ends a request to the pool that was abandoned without a response. It says nothing
+// about the health of the pool, so it is not counted, but a half-open probe is released so
+// another request can test the pool
+func (bs *breakerSet) cancel(poolID string) {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	bs.getBreaker(poolID).probing = false
+}
+
+// recordRequest tracks the outcome of a request to the pool made with ctx. Requests cancelled
+// by the client are not counted; requests cut off by a deadline count as timeouts
+func (bs *breakerSet) recordRequest(ctx context.Context, poolID string, statusCode int) {
+	switch err := ctx.Err(); {
+	case errors.Is(err, context.DeadlineExceeded):
+		bs.record(poolID, http.StatusRequestTimeout)
+	case err != nil:
+		bs.cancel(poolID)
+	default:
+		bs.record(poolID, statusCode)
+	}
+}
+
+// states returns the current breaker state of every pool that has been contacted
+func (bs *breakerSet) states() map[string]string {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	out := make(map[string]string)
+	for id, b := range bs.breakers {
+		out[id] = b.state.String()
+	}
+	return out
+}
+
+func (bs *breakerSet) getBreaker(poolID string) *poolBreaker {
+	b, ok := bs.breakers[poolID]
+	if !ok {
+		b = &poolBreaker{state: breakerClosed}
+		bs.breakers[poolID] = b
+		bs.stateGauge.WithLabelValues(poolID).Set(float64(breakerClosed))
+	}
+	return b
+}
+
+func (bs *breakerSet) setState(poolID string, b *poolBreaker, state breakerState) {
+	b.state = state
+	bs.stateGauge.WithLabelValues(poolID).Set(float64(state))
+}
+
+// isPoolFailure returns true for status codes that indicate the pool itself is in trouble,
+// including the 502 reported when a pool can't be reached at all. Not implemented and other
+// client errors are expected responses and do not count
+func isPoolFailure(statusCode int) bool {
+	switch statusCode {
+	case http.StatusRequestTimeout, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// breakerMessage is the warning reported when a pool request is short-circuited
+func breakerMessage(pool *pool) string {
+	return fmt.Sprintf("%s is temporarily unavailable", pool.V4ID.Name)
+}
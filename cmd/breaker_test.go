@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBreakers is shared by all test runs since the breaker metrics can only be registered once
+var testBreakers = sync.OnceValue(func() *breakerSet { return newBreakerSet(2, 30) })
+
+func TestBreakerRecordRequest(t *testing.T) {
+	badRequest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad query", http.StatusBadRequest)
+	}))
+	defer badRequest.Close()
+	reset := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer reset.Close()
+
+	bs := testBreakers()
+	client := &http.Client{Timeout: 5 * time.Second}
+	tests := []struct {
+		name       string
+		url        string
+		wantStatus int
+		wantState  string
+	}{
+		{name: "pool rejects the request", url: badRequest.URL, wantStatus: http.StatusBadRequest, wantState: "closed"},
+		{name: "connection closed without a response", url: reset.URL, wantStatus: http.StatusBadGateway, wantState: "open"},
+		{name: "unknown host", url: "http://pool.invalid", wantStatus: http.StatusBadGateway, wantState: "open"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < bs.maxFailures; i++ {
+				resp := serviceRequest(context.Background(), "GET", tt.url, nil, nil, client)
+				if resp.StatusCode != tt.wantStatus {
+					t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+				}
+				bs.recordRequest(context.Background(), tt.name, resp.StatusCode)
+			}
+			if got := bs.states()[tt.name]; got != tt.wantState {
+				t.Errorf("breaker is %s, want %s", got, tt.wantState)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// exportColumn is a single column of a tabular export (Excel, CSV) or an extra line in a PDF
+type exportColumn struct {
+	Name  string
+	Label string
+	Value func(item *itemDetail, baseURL string) string
+}
+
+// builtinColumns are columns that are built from the parsed item detail rather than the raw field list
+var builtinColumns = map[string]exportColumn{
+	"title": {Name: "title", Label: "Title", Value: func(item *itemDetail, baseURL string) string {
+		return strings.Join(item.Title, "; ")
+	}},
+	"author": {Name: "author", Label: "Author", Value: func(item *itemDetail, baseURL string) string {
+		return strings.Join(item.Author, "; ")
+	}},
+	"library": {Name: "library", Label: "Library", Value: func(item *itemDetail, baseURL string) string {
+		return strings.Join(item.Library, "; ")
+	}},
+	"location": {Name: "location", Label: "Location", Value: func(item *itemDetail, baseURL string) string {
+		return strings.Join(item.Location, "; ")
+	}},
+	"call_number": {Name: "call_number", Label: "Call Number", Value: func(item *itemDetail, baseURL string) string {
+		return strings.Join(item.CallNumber, "; ")
+	}},
+	"format": {Name: "format", Label: "Format", Value: func(item *itemDetail, baseURL string) string {
+		return strings.Join(item.Format, "; ")
+	}},
+	"published_date": {Name: "published_date", Label: "Date", Value: func(item *itemDetail, baseURL string) string {
+		return item.Date
+	}},
+	"url": {Name: "url", Label: "URL", Value: func(item *itemDetail, baseURL string) string {
+		return itemURL(baseURL, item)
+	}},
+}
+
+// exportProfiles are named lists of fields that can be requested instead of an explicit field list
+var exportProfiles = map[string][]string{
+	"default": {"title", "author", "library", "location", "call_number", "format", "published_date", "url"},
+	"reading_list": {"title", "author", "edition", "publisher_name", "published_date", "isbn", "issn",
+		"subject", "format", "availability", "library", "location", "call_number", "url"},
+	"pull_list": {"title", "author", "library", "location", "call_number", "availability", "url"},
+}
+
+// exportColumns returns the columns requested by the field list or profile in an export request.
+// With neither, the default profile is used
+func exportColumns(req *exportRequest, details []*itemDetail) ([]exportColumn, error) {
+	fields := req.Fields
+	if len(fields) == 0 {
+		profile := req.Profile
+		if profile == "" {
+			profile = "default"
+		}
+		var ok bool
+		fields, ok = exportProfiles[profile]
+		if !ok {
+			return nil, fmt.Errorf("unknown export profile %s", profile)
+		}
+	}
+
+	cols := make([]exportColumn, 0, len(fields))
+	for _, name := range fields {
+		if col, ok := builtinColumns[name]; ok {
+			cols = append(cols, col)
+			continue
+		}
+		cols = append(cols, fieldColumn(name, details))
+	}
+	return cols, nil
+}
+
+// fieldColumn returns a column for any field in the pool resource response. The
+// column label is taken from the first item that provides a label for the field
+func fieldColumn(name string, details []*itemDetail) exportColumn {
+	label := name
+	for _, item := range details {
+		if l, ok := item.Labels[name]; ok && l != "" {
+			label = l
+			break
+		}
+	}
+	return exportColumn{Name: name, Label: label, Value: func(item *itemDetail, baseURL string) string {
+		return strings.Join(item.Fields[name], "; ")
+	}}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// notModified sets the ETag, Last-Modified and Cache-Control headers for a cached response
+// and checks the request's If-None-Match and If-Modified-Since headers against them. The
+// response may be cached until the next scheduled refresh. If the client copy is current a
+// 304 is sent and true is returned. Responses without a version (the cache has not been
+// loaded yet) are never cached
+func notModified(c *gin.Context, version string, modified time.Time, nextRefresh time.Time) bool {
+	if version == "" {
+		c.Header("Cache-Control", "no-cache")
+		return false
+	}
+
+	etag := fmt.Sprintf("\"%s\"", version)
+	maxAge := max(int(time.Until(nextRefresh).Seconds()), 0)
+	c.Header("ETag", etag)
+	c.Header("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	c.Header("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+
+	// If-None-Match takes precedence; If-Modified-Since is only checked without it
+	if inm := c.GetHeader("If-None-Match"); inm != "" {
+		if etagMatches(inm, etag) == false {
+			return false
+		}
+	} else if ims := c.GetHeader("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err != nil || modified.Truncate(time.Second).After(since) {
+			return false
+		}
+	} else {
+		return false
+	}
+
+	c.Status(http.StatusNotModified)
+	return true
+}
+
+// etagMatches checks an If-None-Match header value against an entity tag using weak comparison
+func etagMatches(header string, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
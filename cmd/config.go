@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"log"
+	"strings"
 )
 
 // SolrConfig wraps up the config for solr acess
@@ -11,16 +12,35 @@ type SolrConfig struct {
 	Core string
 }
 
+// HealthConfig contains the thresholds used to decide overall service health
+type HealthConfig struct {
+	SlowMS       int64
+	FilterAgeSec int
+	MaxDownPools int
+}
+
+// PDFConfig contains the font settings used to render PDFs
+type PDFConfig struct {
+	FontDirs []string
+	Fonts    []string
+}
+
 // ServiceConfig defines all of the archives transfer service configuration paramaters
 type ServiceConfig struct {
-	DBHost       string
-	DBPort       int
-	DBName       string
-	DBUser       string
-	DBPass       string
-	Port         int
-	JWTKey       string
-	Solr         SolrConfig
+	DBHost        string
+	DBPort        int
+	DBName        string
+	DBUser        string
+	DBPass        string
+	Port          int
+	JWTKey        string
+	UIURL         string
+	Solr          SolrConfig
+	Health        HealthConfig
+	PDF           PDFConfig
+	JobRetention  int
+	Details       DetailConfig
+	SearchTimeout int
 }
 
 // LoadConfiguration will load the service configuration from env/cmdline
@@ -35,16 +55,52 @@ func LoadConfiguration() *ServiceConfig {
 	flag.StringVar(&cfg.DBUser, "dbuser", "v4user", "Database user")
 	flag.StringVar(&cfg.DBPass, "dbpass", "pass", "Database password")
 	flag.StringVar(&cfg.JWTKey, "jwtkey", "", "JWT signature key")
+	flag.IntVar(&cfg.SearchTimeout, "searchtimeout", 8, "Seconds to wait for pool search responses before returning partial results")
+	flag.IntVar(&cfg.JobRetention, "jobretention", 60, "Minutes that finished export jobs are kept")
+	flag.StringVar(&cfg.UIURL, "uiurl", "https://search.lib.virginia.edu", "Public Virgo UI URL used for item links in exports")
 
 	// Solr config
 	flag.StringVar(&cfg.Solr.URL, "solr", "", "Solr URL for journal browse")
 	flag.StringVar(&cfg.Solr.Core, "core", "test_core", "Solr core for journal browse")
 
+	// Healthcheck thresholds
+	flag.Int64Var(&cfg.Health.SlowMS, "hcslow", 2000, "Pool identify latency (ms) considered degraded")
+	flag.IntVar(&cfg.Health.FilterAgeSec, "hcfilterage", 900, "Filter cache age (sec) considered degraded")
+	flag.IntVar(&cfg.Health.MaxDownPools, "hcmaxdown", 3, "Number of unreachable pools considered unhealthy")
+
+	// Item detail request limits
+	flag.IntVar(&cfg.Details.Workers, "detailworkers", 20, "Maximum item detail requests in flight for one export")
+	flag.IntVar(&cfg.Details.PoolConcurrency, "poolconcurrency", 5, "Maximum item detail requests in flight to each pool")
+	flag.Float64Var(&cfg.Details.PoolRate, "poolrate", 0, "Maximum item detail requests per second to each pool; 0 for no limit")
+	flag.IntVar(&cfg.Details.BatchSize, "batchsize", 50, "Maximum items in one batch request to pools that support it")
+
+	// PDF fonts
+	var fontDirs, fonts string
+	flag.StringVar(&fontDirs, "fontdirs", "./ttf,/usr/share/fonts", "Comma separated list of directories (and their subdirectories) searched for PDF fonts")
+	flag.StringVar(&fonts, "fonts", "OpenSans,NotoSans,NotoSansHebrew,NotoSansArabic,DroidSansFallbackFull", "Comma separated PDF font fallback chain; the first font is required")
+
 	flag.Parse()
 
+	if cfg.SearchTimeout < 1 {
+		log.Fatal("searchtimeout must be positive")
+	}
+	if cfg.Details.Workers < 1 || cfg.Details.PoolConcurrency < 1 || cfg.Details.BatchSize < 1 || cfg.Details.PoolRate < 0 {
+		log.Fatal("detailworkers, poolconcurrency and batchsize must be positive and poolrate must not be negative")
+	}
+	cfg.PDF.FontDirs = splitList(fontDirs)
+	cfg.PDF.Fonts = splitList(fonts)
+	if len(cfg.PDF.FontDirs) == 0 || len(cfg.PDF.Fonts) == 0 {
+		log.Fatal("fontdirs and fonts params are required")
+	}
+
 	if cfg.JWTKey == "" {
 		log.Fatal("jwtkey param is required")
 	}
+	uiURL, err := validateBaseURL(cfg.UIURL)
+	if err != nil {
+		log.Fatalf("uiurl param is invalid: %s", err.Error())
+	}
+	cfg.UIURL = uiURL
 	if cfg.Solr.URL == "" || cfg.Solr.Core == "" {
 		log.Fatal("solr and core params are required")
 	} else {
@@ -53,3 +109,14 @@ func LoadConfiguration() *ServiceConfig {
 
 	return &cfg
 }
+
+// splitList splits a comma separated param into its trimmed, non-empty values
+func splitList(val string) []string {
+	out := make([]string, 0)
+	for _, v := range strings.Split(val, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
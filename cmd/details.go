@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DetailConfig limits the item detail requests made to the pools during exports
+type DetailConfig struct {
+	Workers         int
+	PoolConcurrency int
+	PoolRate        float64
+	BatchSize       int
+}
+
+// detailLimiter bounds the item detail requests made to each pool across all exports.
+// Each pool has a fixed number of request slots and an optional minimum interval between requests
+type detailLimiter struct {
+	cfg      DetailConfig
+	interval time.Duration
+	lock     sync.Mutex
+	slots    map[string]chan struct{}
+	next     map[string]time.Time
+}
+
+func newDetailLimiter(cfg DetailConfig) *detailLimiter {
+	dl := detailLimiter{cfg: cfg, slots: make(map[string]chan struct{}), next: make(map[string]time.Time)}
+	if cfg.PoolRate > 0 {
+		dl.interval = time.Duration(float64(time.Second) / cfg.PoolRate)
+	}
+	return &dl
+}
+
+// acquire blocks until a request slot for the pool is free and the pool rate limit allows
+// another request. The slot must be returned with release. If ctx is done first, no slot is
+// held and the context error is returned
+func (dl *detailLimiter) acquire(ctx context.Context, poolID string) error {
+	dl.lock.Lock()
+	slots, ok := dl.slots[poolID]
+	if !ok {
+		slots = make(chan struct{}, dl.cfg.PoolConcurrency)
+		dl.slots[poolID] = slots
+	}
+	dl.lock.Unlock()
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if dl.interval == 0 {
+		return nil
+	}
+	dl.lock.Lock()
+	now := time.Now()
+	start := dl.next[poolID]
+	if start.Before(now) {
+		start = now
+	}
+	dl.next[poolID] = start.Add(dl.interval)
+	dl.lock.Unlock()
+
+	timer := time.NewTimer(start.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		<-slots
+		return ctx.Err()
+	}
+}
+
+func (dl *detailLimiter) release(poolID string) {
+	dl.lock.Lock()
+	slots := dl.slots[poolID]
+	dl.lock.Unlock()
+	<-slots
+}
+
+// batchSize parses the maximum batch size advertised by a pool resource_batch attribute
+func batchSize(val string) int {
+	size, err := strconv.Atoi(val)
+	if err != nil || size < 1 {
+		return 0
+	}
+	return size
+}
+
+// detailTask is a single item detail request; it covers more than one item when batched
+type detailTask struct {
+	pool    *pool
+	indexes []int
+	items   []requestItem
+}
+
+// fetchItems gets the details for all requested items from the pools. Requests to each pool are
+// limited, and are batched for pools that support multi-record lookups. Requests not yet made
+// are skipped once ctx is cancelled. If progress is not nil,
+// it is called as each item detail response arrives
+func (svc *ServiceContext) fetchItems(ctx context.Context, pools []*pool, authorization string, items []requestItem, progress func(*itemDetail)) ([]*itemDetail, []*itemDetail) {
+	headers := map[string]string{
+		"Content-Type":  "application/json",
+		"Authorization": authorization,
+	}
+
+	// group the requests by pool
+	failed := make([]*itemDetail, 0)
+	poolTasks := make(map[*pool][]*detailTask)
+	for idx, item := range items {
+		pool := getPool(pools, item.Pool)
+		if pool == nil {
+			log.Printf("ERROR: Pool %s not found - Skipping", item.Pool)
+			itemResp := &itemDetail{Index: idx, Identifier: item.Identifier, Pool: item.Pool,
+				StatusCode: http.StatusNotFound, Message: "Unknown or unavailable pool"}
+			failed = append(failed, itemResp)
+			if progress != nil {
+				progress(itemResp)
+			}
+			continue
+		}
+		tasks := poolTasks[pool]
+		maxBatch := pool.BatchSize
+		if maxBatch > svc.Details.cfg.BatchSize {
+			maxBatch = svc.Details.cfg.BatchSize
+		}
+		if len(tasks) == 0 || len(tasks[len(tasks)-1].items) >= maxBatch {
+			tasks = append(tasks, &detailTask{pool: pool})
+		}
+		last := tasks[len(tasks)-1]
+		last.indexes = append(last.indexes, idx)
+		last.items = append(last.items, item)
+		poolTasks[pool] = tasks
+	}
+	allTasks := make([]*detailTask, 0)
+	for _, tasks := range poolTasks {
+		allTasks = append(allTasks, tasks...)
+	}
+
+	// Kick off all requests; each waits for a free request slot for its pool and then
+	// for one of the limited workers for this lookup
+	out := make([]*itemDetail, 0)
+	workers := make(chan struct{}, svc.Details.cfg.Workers)
+	collect := func(idx int, results []*itemDetail) {
+		for _, itemResp := range results {
+			if itemResp.StatusCode == http.StatusOK {
+				out = append(out, itemResp)
+			} else {
+				log.Printf("ERROR: unable to get details for %s: %s", itemResp.Identifier, itemResp.Message)
+				failed = append(failed, itemResp)
+			}
+			if progress != nil {
+				progress(itemResp)
+			}
+		}
+	}
+	collected := fanOut(ctx, "details", len(allTasks), func(ctx context.Context, idx int) []*itemDetail {
+		return svc.runDetailTask(ctx, allTasks[idx], headers, workers)
+	}, func(idx int, err error) []*itemDetail {
+		return allTasks[idx].failAll(http.StatusInternalServerError, "Unable to get item details")
+	}, collect)
+	for idx, task := range allTasks {
+		if collected[idx] == false {
+			collect(idx, task.failAll(statusClientClosed, "Request cancelled"))
+		}
+	}
+
+	// responses arrive in completion order; put them back in request order
+	byRequestOrder(out)
+	byRequestOrder(failed)
+
+	return out, failed
+}
+
+// runDetailTask makes the item detail request for a task once a pool request slot and a worker are free
+func (svc *ServiceContext) runDetailTask(ctx context.Context, task *detailTask, headers map[string]string, workers chan struct{}) []*itemDetail {
+	poolID := task.pool.V4ID.ID
+	if err := svc.Details.acquire(ctx, poolID); err != nil {
+		return task.failAll(statusClientClosed, "Request cancelled")
+	}
+	defer svc.Details.release(poolID)
+	select {
+	case workers <- struct{}{}:
+	case <-ctx.Done():
+		return task.failAll(statusClientClosed, "Request cancelled")
+	}
+	defer func() { <-workers }()
+
+	if ctx.Err() != nil {
+		return task.failAll(statusClientClosed, "Request cancelled")
+	}
+	if len(task.items) == 1 {
+		return []*itemDetail{svc.getDetails(ctx, task.indexes[0], task.items[0], task.pool, headers)}
+	}
+	return svc.getBatchDetails(ctx, task, task.pool, headers)
+}
+
+// failAll returns a failed item detail for every item in the task
+func (task *detailTask) failAll(status int, message string) []*itemDetail {
+	out := make([]*itemDetail, 0, len(task.items))
+	for i, item := range task.items {
+		out = append(out, &itemDetail{Index: task.indexes[i], StatusCode: status, Message: message,
+			Identifier: item.Identifier, Pool: task.pool.V4ID.ID})
+	}
+	return out
+}
+
+type parsedField struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// failedDetail returns the failed item detail for an unsuccessful pool response
+func failedDetail(idx int, item requestItem, pool *pool, resp timedResponse) *itemDetail {
+	respItem := &itemDetail{Index: idx, StatusCode: resp.StatusCode, ElapsedMS: resp.ElapsedMS, Identifier: item.Identifier, Pool: pool.V4ID.ID}
+	respItem.Message = string(resp.Response)
+	if respItem.Message == "" {
+		respItem.Message = http.StatusText(resp.StatusCode)
+	}
+	return respItem
+}
+
+func (svc *ServiceContext) getDetails(ctx context.Context, idx int, item requestItem, pool *pool, headers map[string]string) *itemDetail {
+	if svc.Breakers.allow(pool.V4ID.ID) == false {
+		log.Printf("WARNING: circuit breaker for %s is open; skipping %s details", pool.V4ID.ID, item.Identifier)
+		return &itemDetail{Index: idx, StatusCode: http.StatusServiceUnavailable, Message: breakerMessage(pool),
+			Identifier: item.Identifier, Pool: pool.V4ID.ID}
+	}
+	url := fmt.Sprintf("%s/api/resource/%s", pool.PrivateURL, item.Identifier)
+	resp := serviceRequest(ctx, "GET", url, nil, headers, svc.HTTPClient)
+	svc.Breakers.recordRequest(ctx, pool.V4ID.ID, resp.StatusCode)
+	if resp.StatusCode != http.StatusOK {
+		return failedDetail(idx, item, pool, resp)
+	}
+
+	var parsedResp struct {
+		Fields []parsedField `json:"fields"`
+	}
+	respItem := &itemDetail{Index: idx, StatusCode: resp.StatusCode, ElapsedMS: resp.ElapsedMS, Identifier: item.Identifier, Pool: pool.V4ID.ID}
+	err := json.Unmarshal(resp.Response, &parsedResp)
+	if err != nil {
+		log.Printf("ERROR: Unable to parse response %+v", err)
+		respItem.StatusCode = http.StatusInternalServerError
+		respItem.Message = "Malformed item response"
+		return respItem
+	}
+	respItem.setFields(parsedResp.Fields)
+	return respItem
+}
+
+// getBatchDetails gets the details for several items from a pool that supports multi-record lookups.
+// Items missing from the response are reported as not found
+func (svc *ServiceContext) getBatchDetails(ctx context.Context, task *detailTask, pool *pool, headers map[string]string) []*itemDetail {
+	out := make([]*itemDetail, 0, len(task.items))
+	if svc.Breakers.allow(pool.V4ID.ID) == false {
+		log.Printf("WARNING: circuit breaker for %s is open; skipping %d item details", pool.V4ID.ID, len(task.items))
+		return task.failAll(http.StatusServiceUnavailable, breakerMessage(pool))
+	}
+
+	req := struct {
+		Identifiers []string `json:"identifiers"`
+	}{}
+	for _, item := range task.items {
+		req.Identifiers = append(req.Identifiers, item.Identifier)
+	}
+	body, _ := json.Marshal(req)
+	url := fmt.Sprintf("%s/api/resources", pool.PrivateURL)
+	resp := serviceRequest(ctx, "POST", url, body, headers, svc.HTTPClient)
+	svc.Breakers.recordRequest(ctx, pool.V4ID.ID, resp.StatusCode)
+	if resp.StatusCode != http.StatusOK {
+		for i, item := range task.items {
+			out = append(out, failedDetail(task.indexes[i], item, pool, resp))
+		}
+		return out
+	}
+
+	var parsedResp struct {
+		Resources []struct {
+			Identifier string        `json:"identifier"`
+			Fields     []parsedField `json:"fields"`
+		} `json:"resources"`
+	}
+	parseErr := json.Unmarshal(resp.Response, &parsedResp)
+	if parseErr != nil {
+		log.Printf("ERROR: Unable to parse batch response %+v", parseErr)
+	}
+	found := make(map[string][]parsedField)
+	for _, res := range parsedResp.Resources {
+		found[res.Identifier] = res.Fields
+	}
+	for i, item := range task.items {
+		respItem := &itemDetail{Index: task.indexes[i], StatusCode: http.StatusOK, ElapsedMS: resp.ElapsedMS, Identifier: item.Identifier, Pool: pool.V4ID.ID}
+		fields, ok := found[item.Identifier]
+		if parseErr != nil {
+			respItem.StatusCode = http.StatusInternalServerError
+			respItem.Message = "Malformed item response"
+		} else if !ok {
+			respItem.StatusCode = http.StatusNotFound
+			respItem.Message = http.StatusText(http.StatusNotFound)
+		} else {
+			respItem.setFields(fields)
+		}
+		out = append(out, respItem)
+	}
+	return out
+}
+
+// setFields fills in the item detail from the fields of a pool resource response
+func (respItem *itemDetail) setFields(fields []parsedField) {
+	respItem.Fields = make(map[string][]string)
+	respItem.Labels = make(map[string]string)
+	for _, field := range fields {
+		respItem.Fields[field.Name] = append(respItem.Fields[field.Name], field.Value)
+		if _, ok := respItem.Labels[field.Name]; !ok {
+			respItem.Labels[field.Name] = field.Label
+		}
+		if field.Type == "title" {
+			respItem.Title = append(respItem.Title, field.Value)
+		}
+		if field.Name == "author" {
+			respItem.Author = append(respItem.Author, field.Value)
+		}
+		if field.Name == "library" {
+			respItem.Library = append(respItem.Library, field.Value)
+		}
+		if field.Name == "format" {
+			respItem.Format = append(respItem.Format, field.Value)
+		}
+		if field.Name == "published_date" {
+			respItem.Date = field.Value
+		}
+		if field.Name == "location" {
+			if field.Value != "By Request" {
+				respItem.Location = append(respItem.Location, field.Value)
+			}
+		}
+		if field.Name == "call_number" {
+			respItem.CallNumber = append(respItem.CallNumber, field.Value)
+		}
+	}
+}
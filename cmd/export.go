@@ -1,17 +1,16 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"os"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/signintech/gopdf"
 	"github.com/xuri/excelize/v2"
 )
 
@@ -20,12 +19,20 @@ type requestItem struct {
 	Identifier string `json:"identifier"`
 }
 type exportRequest struct {
-	Title string        `json:"title"`
-	Notes string        `json:"notes"`
-	Items []requestItem `json:"items"`
+	Title    string        `json:"title"`
+	Notes    string        `json:"notes"`
+	BaseURL  string        `json:"base_url"`
+	Items    []requestItem `json:"items"`
+	Fields   []string      `json:"fields"`
+	Profile  string        `json:"profile"`
+	Sort     string        `json:"sort"`
+	Layout   string        `json:"layout"`
+	PageSize string        `json:"page_size"`
+	Margin   *int          `json:"margin"`
 }
 
 type itemDetail struct {
+	Index      int
 	Identifier string
 	Pool       string
 	CallNumber []string
@@ -35,14 +42,18 @@ type itemDetail struct {
 	Library    []string
 	Location   []string
 	Format     []string
+	Fields     map[string][]string
+	Labels     map[string]string
 	StatusCode int
 	Message    string
 	ElapsedMS  int64
 }
 
 // ExportBookmarks accepts a list of objects containg pool and identifer as POST data
-// It will generate and Excel spreadsheet containing details about the items
+// It will generate and Excel spreadsheet containing details about the items. The format
+// query param can be used to request csv, ris, bibtex, endnote or marcxml instead
 func (svc *ServiceContext) ExportBookmarks(c *gin.Context) {
+	format := strings.ToLower(c.DefaultQuery("format", "xlsx"))
 	var req exportRequest
 	if err := c.BindJSON(&req); err != nil {
 		log.Printf("ERROR: Unable to parse CSV request: %s", err.Error())
@@ -50,16 +61,15 @@ func (svc *ServiceContext) ExportBookmarks(c *gin.Context) {
 		return
 	}
 
-	// Notes is used to pass in the base URL of the request. Need
-	// it to generate the full item details URL
-	if req.Notes == "" {
-		log.Printf("ERROR: Missing required notes field")
-		c.String(http.StatusBadRequest, "Invalid CSV request")
+	fmtInfo, baseURL, err := svc.validateExport(&req, format)
+	if err != nil {
+		log.Printf("ERROR: Invalid export request: %s", err.Error())
+		c.String(http.StatusBadRequest, err.Error())
 		return
 	}
 
 	start := time.Now()
-	details, err := svc.lookupItems(c, req.Items)
+	details, failed, err := svc.lookupItems(c, req.Items)
 	elapsed := time.Since(start)
 	elapsedMS := int64(elapsed / time.Millisecond)
 	if err != nil {
@@ -68,240 +78,163 @@ func (svc *ServiceContext) ExportBookmarks(c *gin.Context) {
 		return
 	}
 
-	log.Printf("SUCCESS: All item details for CSV receieved in %dms", elapsedMS)
-	xf := excelize.NewFile()
-	bm, err := xf.NewSheet("Bookmarks")
-	if err != nil {
-		log.Printf("ERROR: Unable to create new bookmark spreadsheet %s", err.Error())
-		c.String(http.StatusInternalServerError, "Unable create new bookmark spreadsheet")
-		return
-	}
-
-	xf.SetCellValue("Bookmarks", "A1", "Title")
-	xf.SetCellValue("Bookmarks", "B1", "Author")
-	xf.SetCellValue("Bookmarks", "C1", "Library")
-	xf.SetCellValue("Bookmarks", "D1", "Location")
-	xf.SetCellValue("Bookmarks", "E1", "Call Number")
-	xf.SetCellValue("Bookmarks", "F1", "Format")
-	xf.SetCellValue("Bookmarks", "G1", "Date")
-	xf.SetCellValue("Bookmarks", "H1", "URL")
-
-	baseURL := req.Notes
-	for idx, item := range details {
-		url := fmt.Sprintf("%s/sources/%s/items/%s", baseURL, item.Pool, item.Identifier)
-		xf.SetCellValue("Bookmarks", fmt.Sprintf("A%d", (idx+2)), strings.Join(item.Title, "; "))
-		xf.SetCellValue("Bookmarks", fmt.Sprintf("B%d", (idx+2)), strings.Join(item.Author, "; "))
-		xf.SetCellValue("Bookmarks", fmt.Sprintf("C%d", (idx+2)), strings.Join(item.Library, "; "))
-		xf.SetCellValue("Bookmarks", fmt.Sprintf("D%d", (idx+2)), strings.Join(item.Location, "; "))
-		xf.SetCellValue("Bookmarks", fmt.Sprintf("E%d", (idx+2)), strings.Join(item.CallNumber, "; "))
-		xf.SetCellValue("Bookmarks", fmt.Sprintf("F%d", (idx+2)), strings.Join(item.Format, "; "))
-		xf.SetCellValue("Bookmarks", fmt.Sprintf("G%d", (idx+2)), item.Date)
-		xf.SetCellValue("Bookmarks", fmt.Sprintf("H%d", (idx+2)), url)
-	}
-	xf.SetActiveSheet(bm)
-	fileName := fmt.Sprintf("/tmp/v4-bookmark-export-%d.xlsx", start.Unix())
-	log.Printf("INFO: write excel bookmarks export to %s", fileName)
-	if err := xf.SaveAs(fileName); err != nil {
-		fmt.Println(err)
+	log.Printf("SUCCESS: All item details for %s export receieved in %dms; %d failed", format, elapsedMS, len(failed))
+	setFailureHeaders(c, len(req.Items), failed)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fmtInfo.FileName))
+	c.Header("Content-Type", fmtInfo.ContentType)
+	if err := writeExport(c.Writer, fmtInfo, &req, baseURL, details, failed); err != nil {
+		log.Printf("ERROR: Unable to write %s export: %s", format, err.Error())
+		// if nothing has been streamed yet, the client can still be told it failed
+		if c.Writer.Written() == false {
+			c.Writer.Header().Del("Content-Disposition")
+			c.Writer.Header().Del("Content-Type")
+			c.String(http.StatusInternalServerError, fmt.Sprintf("Unable to generate %s export", format))
+		}
 	}
-	c.Header("Content-Type", "application/vnd.ms-excel")
-	c.File(fileName)
-	os.Remove(fileName)
 }
 
-// // GenerateCSV accepts a list of objects containg pool and identifer as POST data
-// // It will generate CSV containing details about the items
-// func (svc *ServiceContext) GenerateCSV(c *gin.Context) {
-// 	var req exportRequest
-// 	if err := c.BindJSON(&req); err != nil {
-// 		log.Printf("ERROR: Unable to parse CSV request: %s", err.Error())
-// 		c.String(http.StatusBadRequest, "Invalid CSV request")
-// 		return
-// 	}
-
-// 	// Notes is used to pass in the base URL of the request. Need
-// 	// it to generate the full item details URL
-// 	if req.Notes == "" {
-// 		log.Printf("ERROR: Missing required notes field")
-// 		c.String(http.StatusBadRequest, "Invalid CSV request")
-// 		return
-// 	}
-
-// 	start := time.Now()
-// 	details, err := svc.lookupItems(c, req.Items)
-// 	elapsed := time.Since(start)
-// 	elapsedMS := int64(elapsed / time.Millisecond)
-// 	if err != nil {
-// 		log.Printf("ERROR: Unable to get CSV item details: %s", err.Error())
-// 		c.String(http.StatusNotFound, "Unable to find item details")
-// 		return
-// 	}
-// 	log.Printf("SUCCESS: All item details for CSV receieved in %dms", elapsedMS)
-// 	c.Header("Content-Type", "text/csv")
-// 	cw := csv.NewWriter(c.Writer)
-// 	csvHead := []string{"title", "author", "library", "location", "call number", "format", "date", "url"}
-// 	cw.Write(csvHead)
-// 	baseURL := req.Notes
-// 	for _, item := range details {
-// 		url := fmt.Sprintf("%s/sources/%s/items/%s", baseURL, item.Pool, item.Identifier)
-// 		line := []string{
-// 			strings.Join(item.Title, "; "),
-// 			strings.Join(item.Author, "; "),
-// 			strings.Join(item.Library, "; "),
-// 			strings.Join(item.Location, "; "),
-// 			strings.Join(item.CallNumber, "; "),
-// 			strings.Join(item.Format, "; "),
-// 			item.Date,
-// 			url,
-// 		}
-// 		cw.Write(line)
-// 	}
-
-// 	cw.Flush()
-// }
-
-func (svc *ServiceContext) lookupItems(c *gin.Context, items []requestItem) ([]*itemDetail, error) {
-	// Pools have already been placed in request context by poolsMiddleware. Get them or fail
-	pools := getPoolsFromContext(c)
-	if len(pools) == 0 {
-		return nil, errors.New("No pools found")
+// validateExport checks the format, base URL, sort and columns of an export request.
+// It returns the export format and the base URL used for item links
+func (svc *ServiceContext) validateExport(req *exportRequest, format string) (exportFormat, string, error) {
+	fmtInfo, supported := exportFormats[format]
+	if supported == false {
+		return fmtInfo, "", fmt.Errorf("Unsupported export format %s", format)
 	}
 
-	headers := map[string]string{
-		"Content-Type":  "application/json",
-		"Authorization": c.GetHeader("Authorization"),
+	// base URL is needed to generate the full item details URL
+	baseURL, err := svc.exportBaseURL(req)
+	if err != nil {
+		return fmtInfo, "", err
 	}
 
-	// Kick off all pool requests in parallel and wait for all to respond
-	channel := make(chan *itemDetail)
-	outstandingRequests := 0
-	for _, item := range items {
-		outstandingRequests++
-		pool := getPool(pools, item.Pool)
-		if pool == nil {
-			log.Printf("ERROR: Pool %s not found - Skipping", item.Pool)
-		}
-		go svc.getDetails(item, pool, headers, channel)
+	if _, ok := itemSorts[req.Sort]; req.Sort != "" && !ok {
+		return fmtInfo, "", fmt.Errorf("Unsupported sort %s", req.Sort)
 	}
 
-	out := make([]*itemDetail, 0)
-	for outstandingRequests > 0 {
-		itemResp := <-channel
-		if itemResp.StatusCode == http.StatusOK {
-			out = append(out, itemResp)
-		} else {
-			log.Printf("ERROR: unable to get details for %s: %s", itemResp.Identifier, itemResp.Message)
-		}
-		outstandingRequests--
+	if _, err := exportColumns(req, nil); err != nil {
+		return fmtInfo, "", err
 	}
+	return fmtInfo, baseURL, nil
+}
 
-	return out, nil
+// writeExport sorts the item details and writes them to w in the export format
+func writeExport(w io.Writer, fmtInfo exportFormat, req *exportRequest, baseURL string, details []*itemDetail, failed []*itemDetail) error {
+	sortItems(details, req.Sort)
+	cols, _ := exportColumns(req, details)
+	opts := exportOptions{Title: req.Title, Notes: req.Notes, BaseURL: baseURL, Columns: cols, Failed: failed}
+	return fmtInfo.Write(w, details, &opts)
 }
 
-// GeneratePDF accepts a list of objects containg pool and identifer as POST data
-// It will generate a PDF containing details about the items that can be used to help find
-// the items in the stacks
-func (svc *ServiceContext) GeneratePDF(c *gin.Context) {
-	var req exportRequest
-	if err := c.BindJSON(&req); err != nil {
-		log.Printf("ERROR: Unable to parse PDF request: %s", err.Error())
-		c.String(http.StatusBadRequest, "Invalid PDF request")
-		return
+// exportBaseURL returns the validated client base URL used to build item links. If the
+// request does not include one, the configured public UI URL is used
+func (svc *ServiceContext) exportBaseURL(req *exportRequest) (string, error) {
+	if req.BaseURL == "" {
+		return svc.UIURL, nil
 	}
+	return validateBaseURL(req.BaseURL)
+}
 
-	pdf := gopdf.GoPdf{}
-	pdf.Start(gopdf.Config{PageSize: *gopdf.PageSizeA4}) // W: 595, H: 842
-	pdf.AddPage()
-	err := pdf.AddTTFFont("osr", "./ttf/OpenSans-Regular.ttf")
+// validateBaseURL ensures a base URL is an absolute http(s) URL and returns it without
+// a trailing slash
+func validateBaseURL(baseURL string) (string, error) {
+	parsed, err := url.Parse(baseURL)
 	if err != nil {
-		log.Printf("ERROR: Unable to load PDF font %s", err.Error())
-		c.String(http.StatusInternalServerError, "Unable to generate PDF")
-		return
+		return "", fmt.Errorf("invalid base url %s", baseURL)
 	}
-	err = pdf.AddTTFFont("osb", "./ttf/OpenSans-Bold.ttf")
-	if err != nil {
-		log.Printf("ERROR: Unable to load PDF bold font %s", err.Error())
-		c.String(http.StatusInternalServerError, "Unable to generate PDF")
-		return
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", fmt.Errorf("base url %s must be an absolute http or https url", baseURL)
+	}
+	if parsed.RawQuery != "" || parsed.Fragment != "" {
+		return "", fmt.Errorf("base url %s must not include a query or fragment", baseURL)
 	}
+	return strings.TrimSuffix(baseURL, "/"), nil
+}
 
-	start := time.Now()
-	out, err := svc.lookupItems(c, req.Items)
-	elapsed := time.Since(start)
-	elapsedMS := int64(elapsed / time.Millisecond)
+// writeExcel streams an Excel workbook containing the item details to the writer. A
+// second sheet contains the export title and notes
+func writeExcel(w io.Writer, details []*itemDetail, opts *exportOptions) error {
+	xf := excelize.NewFile()
+	defer xf.Close()
+	if err := xf.SetSheetName("Sheet1", "Bookmarks"); err != nil {
+		return err
+	}
+
+	sw, err := xf.NewStreamWriter("Bookmarks")
 	if err != nil {
-		log.Printf("ERROR: Unable to get PDF item details: %s", err.Error())
-		c.String(http.StatusNotFound, "Unable to find item details")
-		return
+		return err
 	}
-	log.Printf("SUCCESS: All item details for printout receieved in %dms", elapsedMS)
 
-	// render the PDF..
-	yPos := 20
-	if req.Title != "" {
-		yPos = renderLine(&pdf, 20, yPos, req.Title, "osb", 12)
+	head := make([]interface{}, 0, len(opts.Columns))
+	for _, col := range opts.Columns {
+		head = append(head, col.Label)
 	}
-	if req.Notes != "" {
-		yPos += 5
-		yPos = renderLine(&pdf, 20, yPos, req.Notes, "osr", 10)
+	if err := sw.SetRow("A1", head); err != nil {
+		return err
 	}
-	if yPos > 20 {
-		yPos += 8
-		pdf.Line(10, float64(yPos), 585, float64(yPos))
-		yPos += 15
+
+	for idx, item := range details {
+		row := make([]interface{}, 0, len(opts.Columns))
+		for _, col := range opts.Columns {
+			row = append(row, col.Value(item, opts.BaseURL))
+		}
+		if err := sw.SetRow(fmt.Sprintf("A%d", (idx+2)), row); err != nil {
+			return err
+		}
 	}
 
-	for _, item := range out {
-		pdf.SetFont("osb", "", 10)
-		yPos = renderLine(&pdf, 20, yPos, strings.Join(item.Title, "; "), "osb", 10)
-		yPos = renderLine(&pdf, 30, yPos, strings.Join(item.Author, "; "), "osr", 10)
-		yPos = renderLine(&pdf, 30, yPos, strings.Join(item.Location, "; "), "osr", 10)
-		yPos = renderLine(&pdf, 30, yPos, strings.Join(item.CallNumber, "; "), "osr", 10)
-		yPos += 10
+	if err := sw.Flush(); err != nil {
+		return err
 	}
 
-	c.Header("Content-Disposition", "attachment; filename=results.pdf")
-	c.Header("Content-Type", "application/pdf")
-	pdf.Write(c.Writer)
-}
+	if _, err := xf.NewSheet("About"); err != nil {
+		return err
+	}
+	about := [][]interface{}{
+		{"Title", opts.Title},
+		{"Notes", opts.Notes},
+		{"Exported", time.Now().Format("2006-01-02 15:04")},
+		{"Items", len(details)},
+		{"Not Retrieved", len(opts.Failed)},
+	}
+	for idx, row := range about {
+		if err := xf.SetSheetRow("About", fmt.Sprintf("A%d", (idx+1)), &row); err != nil {
+			return err
+		}
+	}
 
-// render a line of the PDF with line breaks. return the new Y position
-func renderLine(pdf *gopdf.GoPdf, xPos int, yPos int, line string, fontName string, fontSize int) int {
-	pdf.SetFont(fontName, "", fontSize)
-	words := strings.Fields(line)
-	line = ""
-	for _, word := range words {
-		testLine := line
-		if testLine != "" {
-			testLine += " "
+	if len(opts.Failed) > 0 {
+		if _, err := xf.NewSheet("Not Retrieved"); err != nil {
+			return err
 		}
-		testLine += word
-		lineW, _ := pdf.MeasureTextWidth(testLine)
-		if lineW >= 550 {
-			if yPos+(fontSize+6)+20 > int(gopdf.PageSizeA4.H) {
-				pdf.AddPage()
-				yPos = 20
+		xf.SetSheetRow("Not Retrieved", "A1", &[]interface{}{"Pool", "Identifier", "Reason"})
+		for idx, item := range opts.Failed {
+			row := []interface{}{item.Pool, item.Identifier, item.Message}
+			if err := xf.SetSheetRow("Not Retrieved", fmt.Sprintf("A%d", (idx+2)), &row); err != nil {
+				return err
 			}
-			pdf.SetY(float64(yPos))
-			pdf.SetX(float64(xPos))
-			pdf.Cell(nil, line)
-			yPos += (fontSize + 6)
-			line = word
-		} else {
-			line = testLine
 		}
 	}
-	if line != "" {
-		if yPos+(fontSize+6)+20 > int(gopdf.PageSizeA4.H) {
-			pdf.AddPage()
-			yPos = 20
-		}
-		pdf.SetY(float64(yPos))
-		pdf.SetX(float64(xPos))
-		pdf.Cell(nil, line)
-		yPos += (fontSize + 4)
+	xf.SetActiveSheet(0)
+
+	return xf.Write(w)
+}
+
+// lookupItems gets the details for all requested items. Items that could not be retrieved
+// are returned in a separate list with the reason they failed
+func (svc *ServiceContext) lookupItems(c *gin.Context, items []requestItem) ([]*itemDetail, []*itemDetail, error) {
+	// Pools have already been placed in request context by poolsMiddleware. Get them or fail
+	pools := getPoolsFromContext(c)
+	if len(pools) == 0 {
+		return nil, nil, errors.New("No pools found")
 	}
-	return yPos
+	out, failed := svc.fetchItems(c.Request.Context(), pools, c.GetHeader("Authorization"), items, nil)
+	return out, failed, nil
+}
+
+// setFailureHeaders adds response headers summarizing the items that could not be retrieved
+func setFailureHeaders(c *gin.Context, requested int, failed []*itemDetail) {
+	c.Header("X-Export-Requested", fmt.Sprintf("%d", requested))
+	c.Header("X-Export-Failed", fmt.Sprintf("%d", len(failed)))
 }
 
 func getPool(pools []*pool, identifier string) *pool {
@@ -312,59 +245,3 @@ func getPool(pools []*pool, identifier string) *pool {
 	}
 	return nil
 }
-
-func (svc *ServiceContext) getDetails(item requestItem, pool *pool, headers map[string]string, channel chan *itemDetail) {
-	url := fmt.Sprintf("%s/api/resource/%s", pool.PrivateURL, item.Identifier)
-	resp := serviceRequest("GET", url, nil, headers, svc.HTTPClient)
-	respItem := &itemDetail{StatusCode: resp.StatusCode, ElapsedMS: resp.ElapsedMS, Identifier: item.Identifier, Pool: pool.V4ID.ID}
-	if respItem.StatusCode != http.StatusOK {
-		channel <- respItem
-		return
-	}
-
-	type parsedField struct {
-		Name  string `json:"name"`
-		Type  string `json:"type"`
-		Value string `json:"value"`
-	}
-	var parsedResp struct {
-		Fields []parsedField `json:"fields"`
-	}
-
-	err := json.Unmarshal(resp.Response, &parsedResp)
-	if err != nil {
-		log.Printf("ERROR: Unable to parse response %+v", err)
-		respItem.StatusCode = http.StatusInternalServerError
-		respItem.Message = "Malformed search response"
-		channel <- respItem
-		return
-	}
-
-	for _, field := range parsedResp.Fields {
-		if field.Type == "title" {
-			respItem.Title = append(respItem.Title, field.Value)
-		}
-		if field.Name == "author" {
-			respItem.Author = append(respItem.Author, field.Value)
-		}
-		if field.Name == "library" {
-			respItem.Library = append(respItem.Library, field.Value)
-		}
-		if field.Name == "format" {
-			respItem.Format = append(respItem.Format, field.Value)
-		}
-		if field.Name == "published_date" {
-			respItem.Date = field.Value
-		}
-		if field.Name == "location" {
-			if field.Value != "By Request" {
-				respItem.Location = append(respItem.Location, field.Value)
-			}
-		}
-		if field.Name == "call_number" {
-			respItem.CallNumber = append(respItem.CallNumber, field.Value)
-		}
-	}
-
-	channel <- respItem
-}
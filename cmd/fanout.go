@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	poolCallsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "v4search_pool_calls_in_flight",
+		Help: "Number of pool calls currently in flight, by call type",
+	}, []string{"call"})
+	poolCallPanics = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "v4search_pool_call_panics_total",
+		Help: "Number of pool calls that panicked, by call type",
+	}, []string{"call"})
+)
+
+func init() {
+	prometheus.MustRegister(poolCallsInFlight, poolCallPanics)
+}
+
+type fanOutResult[T any] struct {
+	idx    int
+	result T
+}
+
+// fanOut makes n calls concurrently and passes each result to collect as it arrives, in the
+// collecting goroutine. The result channel is buffered for all n calls so that workers never
+// block if collection stops early. A panic in a call is recovered and converted to a result
+// by recovered. fanOut returns when all calls are done or ctx is done; the returned list
+// reports which calls were collected
+func fanOut[T any](ctx context.Context, call string, n int, work func(ctx context.Context, idx int) T,
+	recovered func(idx int, err error) T, collect func(idx int, result T)) []bool {
+	done := make([]bool, n)
+	channel := make(chan fanOutResult[T], n)
+	for idx := 0; idx < n; idx++ {
+		go fanOutWorker(ctx, call, idx, work, recovered, channel)
+	}
+
+	for outstanding := n; outstanding > 0; outstanding-- {
+		select {
+		case resp := <-channel:
+			done[resp.idx] = true
+			collect(resp.idx, resp.result)
+		case <-ctx.Done():
+			log.Printf("WARNING: %s stopped with %d of %d calls outstanding: %s", call, outstanding, n, ctx.Err().Error())
+			return done
+		}
+	}
+	return done
+}
+
+// Goroutine to make a single fan-out call and return the result on the channel
+func fanOutWorker[T any](ctx context.Context, call string, idx int, work func(ctx context.Context, idx int) T,
+	recovered func(idx int, err error) T, channel chan fanOutResult[T]) {
+	inFlight := poolCallsInFlight.WithLabelValues(call)
+	inFlight.Inc()
+	defer inFlight.Dec()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("ERROR: %s call %d panicked: %v\n%s", call, idx, r, debug.Stack())
+			poolCallPanics.WithLabelValues(call).Inc()
+			channel <- fanOutResult[T]{idx: idx, result: recovered(idx, fmt.Errorf("%v", r))}
+		}
+	}()
+	channel <- fanOutResult[T]{idx: idx, result: work(ctx, idx)}
+}
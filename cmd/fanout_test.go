@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFanOut(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+		// release is the order the calls are allowed to finish in; each is released once the
+		// previous one has been collected. Calls not listed finish after fanOut returns
+		release []int
+		// panics lists the calls that panic instead of returning a result
+		panics []int
+		// cancelAfter cancels the context once that many results are collected, if positive
+		cancelAfter int
+		wantDone    []bool
+		wantOrder   []int
+		wantResults map[int]string
+		wantPanics  float64
+	}{
+		{
+			name:        "no calls",
+			n:           0,
+			wantDone:    []bool{},
+			wantOrder:   []int{},
+			wantResults: map[int]string{},
+		},
+		{
+			name:        "collected in completion order",
+			n:           3,
+			release:     []int{1, 2, 0},
+			wantDone:    []bool{true, true, true},
+			wantOrder:   []int{1, 2, 0},
+			wantResults: map[int]string{0: "call 0", 1: "call 1", 2: "call 2"},
+		},
+		{
+			name:        "panic is recovered",
+			n:           3,
+			release:     []int{0, 1, 2},
+			panics:      []int{1},
+			wantDone:    []bool{true, true, true},
+			wantOrder:   []int{0, 1, 2},
+			wantResults: map[int]string{0: "call 0", 1: "recovered 1: call 1 failed", 2: "call 2"},
+			wantPanics:  1,
+		},
+		{
+			name:        "cancel returns early",
+			n:           3,
+			release:     []int{2},
+			cancelAfter: 1,
+			wantDone:    []bool{false, false, true},
+			wantOrder:   []int{2},
+			wantResults: map[int]string{2: "call 2"},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			call := fmt.Sprintf("test_%d", i)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			gates := make([]chan struct{}, tt.n)
+			for idx := range gates {
+				gates[idx] = make(chan struct{})
+			}
+			if len(tt.release) > 0 {
+				close(gates[tt.release[0]])
+			}
+
+			panics := poolCallPanics.WithLabelValues(call)
+			panicsBefore := testutil.ToFloat64(panics)
+			order := make([]int, 0)
+			results := make(map[int]string)
+			done := fanOut(ctx, call, tt.n, func(_ context.Context, idx int) string {
+				<-gates[idx]
+				if slices.Contains(tt.panics, idx) {
+					panic(fmt.Sprintf("call %d failed", idx))
+				}
+				return fmt.Sprintf("call %d", idx)
+			}, func(idx int, err error) string {
+				return fmt.Sprintf("recovered %d: %s", idx, err.Error())
+			}, func(idx int, result string) {
+				order = append(order, idx)
+				results[idx] = result
+				if len(order) == tt.cancelAfter {
+					cancel()
+				}
+				if len(order) < len(tt.release) {
+					close(gates[tt.release[len(order)]])
+				}
+			})
+
+			if slices.Equal(done, tt.wantDone) == false {
+				t.Errorf("done = %v, want %v", done, tt.wantDone)
+			}
+			if slices.Equal(order, tt.wantOrder) == false {
+				t.Errorf("collect order = %v, want %v", order, tt.wantOrder)
+			}
+			for idx, want := range tt.wantResults {
+				if results[idx] != want {
+					t.Errorf("result %d = %q, want %q", idx, results[idx], want)
+				}
+			}
+			if len(results) != len(tt.wantResults) {
+				t.Errorf("collected %d results, want %d", len(results), len(tt.wantResults))
+			}
+			if got := testutil.ToFloat64(panics) - panicsBefore; got != tt.wantPanics {
+				t.Errorf("panics = %v, want %v", got, tt.wantPanics)
+			}
+
+			// calls still running when fanOut returned must be able to finish without a collector
+			for idx, gate := range gates {
+				if slices.Contains(tt.release, idx) == false {
+					close(gate)
+				}
+			}
+			inFlight := poolCallsInFlight.WithLabelValues(call)
+			for deadline := time.Now().Add(time.Second); testutil.ToFloat64(inFlight) > 0; {
+				if time.Now().After(deadline) {
+					t.Fatalf("%v calls still in flight; workers are blocked", testutil.ToFloat64(inFlight))
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		})
+	}
+}
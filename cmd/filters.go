@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -20,20 +25,40 @@ type filterResponse struct {
 	updated time.Time
 }
 
+// filterSnapshot is an immutable view of the cached filters. Each refresh builds and publishes
+// a new snapshot, so readers must never modify one. The version is derived from the combined
+// filters and only changes when they do; modified is the time of the last change and
+// nextRefresh the time the snapshot is next scheduled to be replaced
+type filterSnapshot struct {
+	sources       []*filterSource
+	normalizer    *filterNormalizer
+	nativeValues  filterValueMap
+	sourceFilters map[string]*filterResponse
+	filters       []v4api.QueryFilter
+	version       string
+	modified      time.Time
+	nextRefresh   time.Time
+}
+
+// filterCache holds the current filter snapshot. The background refresh replaces the
+// snapshot atomically; request goroutines only ever load it
 type filterCache struct {
 	svc             *ServiceContext
 	refreshInterval int
-	sourceFilters   map[string]*filterResponse
-	combinedFilters []v4api.QueryFilter
+	refreshLock     sync.Mutex
+	snapshot        atomic.Pointer[filterSnapshot]
 }
 
 func newFilterCache(svc *ServiceContext, interval int) *filterCache {
 	cache := filterCache{
 		svc:             svc,
 		refreshInterval: interval,
-		sourceFilters:   make(map[string]*filterResponse),
-		combinedFilters: []v4api.QueryFilter{},
 	}
+	initial := newFilterSnapshot(nil, make(map[string]*filterResponse), []v4api.QueryFilter{})
+	initial.sources = defaultFilterSources
+	initial.normalizer = newFilterNormalizer(nil)
+	initial.nativeValues = filterValueMap{}
+	cache.snapshot.Store(initial)
 
 	go cache.monitorFilters()
 
@@ -49,6 +74,9 @@ func (f *filterCache) monitorFilters() {
 }
 
 func (f *filterCache) refreshCache() {
+	f.refreshLock.Lock()
+	defer f.refreshLock.Unlock()
+
 	log.Printf("[FILTERS] refreshing filters...")
 	pools, err := f.svc.lookupPools()
 	if err != nil {
@@ -58,36 +86,79 @@ func (f *filterCache) refreshCache() {
 
 	// query up to one pool of each source that supports filters
 
-	// NOTE: the order of this list dictates the order of preference for
+	// NOTE: the order of the filter sources dictates the order of preference for
 	// attributes of the combined filters, including filter label and sort order.
 	// this is important since a) the solr pools have more translations for shared
 	// filter IDs, and b) only the solr pools currently specify bucket sort order.
-	sources := []string{"solr", "solr-images", "eds"}
+	sources := f.lookupFilterSources()
+	filterPools, filterPoolSources := selectFilterPools(sources, pools)
+
+	// start from the filters of the current snapshot; sources that fail to respond keep
+	// their last known filters
+	prior := f.snapshot.Load()
+	sourceFilters := carryOverFilters(prior, sources)
+
+	// background refreshes are not tied to any client request
+	fanOut(context.Background(), "filters", len(filterPools), func(ctx context.Context, idx int) *filterResponse {
+		return f.getPoolFilters(ctx, filterPools[idx], filterPoolSources[idx], f.svc.SlowHTTPClient)
+	}, func(idx int, err error) *filterResponse {
+		return &filterResponse{pool: filterPools[idx]}
+	}, func(idx int, filterResp *filterResponse) {
+		if filterResp.filters != nil {
+			sourceFilters[filterResp.pool.V4ID.Source] = filterResp
+		}
+	})
 
-	channel := make(chan *filterResponse)
-	outstandingRequests := 0
+	// merge filter lists from each representative pool
+	normalizer := f.lookupFilterValueMappings()
+	combined, nativeValues := mergeFilters(sources, sourceFilters, normalizer)
+
+	snapshot := newFilterSnapshot(prior, sourceFilters, combined)
+	snapshot.sources = sources
+	snapshot.normalizer = normalizer
+	snapshot.nativeValues = nativeValues
+	snapshot.nextRefresh = time.Now().Add(time.Duration(f.refreshInterval) * time.Second)
+	f.snapshot.Store(snapshot)
+	log.Printf("[FILTERS] published filter snapshot version %s", snapshot.version)
+}
 
+// carryOverFilters returns the filters from the prior snapshot for the configured sources.
+// Sources that have been removed or disabled are dropped
+func carryOverFilters(prior *filterSnapshot, sources []*filterSource) map[string]*filterResponse {
+	sourceFilters := make(map[string]*filterResponse)
 	for _, source := range sources {
-		for _, pool := range pools {
-			if pool.V4ID.Source == source {
-				log.Printf("[FILTERS] source [%s] will query pool [%s]", source, pool.V4ID.ID)
-				outstandingRequests++
-				go f.getPoolFilters(pool, channel, f.svc.SlowHTTPClient)
-				break
-			}
+		if resp, ok := prior.sourceFilters[source.Source]; ok {
+			sourceFilters[source.Source] = resp
 		}
 	}
+	return sourceFilters
+}
 
-	for outstandingRequests > 0 {
-		filterResp := <-channel
-		if filterResp.filters != nil {
-			f.sourceFilters[filterResp.pool.V4ID.Source] = filterResp
+// selectFilterPools picks the first pool of each filter source. It returns the pools and
+// the matching filter source for each
+func selectFilterPools(sources []*filterSource, pools []*pool) ([]*pool, []*filterSource) {
+	filterPools := make([]*pool, 0)
+	filterPoolSources := make([]*filterSource, 0)
+	for _, source := range sources {
+		for _, pool := range pools {
+			if pool.V4ID.Source == source.Source {
+				log.Printf("[FILTERS] source [%s] will query pool [%s]", source.Source, pool.V4ID.ID)
+				filterPools = append(filterPools, pool)
+				filterPoolSources = append(filterPoolSources, source)
+				break
+			}
 		}
-		outstandingRequests--
 	}
+	return filterPools, filterPoolSources
+}
 
-	// merge filter lists from each representative pool
-
+// mergeFilters combines the filters from each source into the global filter list. Sources
+// are in order of preference: the first source to label a filter or give it a bucket sort
+// order wins, a filter is hidden if any source hides it, and counts for the same value are
+// summed across sources. Values are normalized to their global value and matched without regard
+// to case; the first source to provide a value sets how it is shown. The native value each
+// source used for the global values is also returned
+func mergeFilters(sources []*filterSource, sourceFilters map[string]*filterResponse, normalizer *filterNormalizer) ([]v4api.QueryFilter, filterValueMap) {
 	type singleFilter struct {
 		source string
 		filter v4api.Facet
@@ -98,12 +169,12 @@ func (f *filterCache) refreshCache() {
 
 	// collect source/filter list for each filter ID
 	for _, source := range sources {
-		filterResp := f.sourceFilters[source]
+		filterResp := sourceFilters[source.Source]
 		if filterResp == nil {
 			continue
 		}
 
-		log.Printf("[FILTERS] source [%s] filters last updated %d seconds ago", source, int(time.Since(filterResp.updated).Seconds()))
+		log.Printf("[FILTERS] source [%s] filters updated %d seconds ago", source.Source, int(time.Since(filterResp.updated).Seconds()))
 
 		for _, facet := range filterResp.filters.FacetList {
 			log.Printf("[FILTERS] source [%s] provided filter: [%s] (%d values)",
@@ -123,6 +194,7 @@ func (f *filterCache) refreshCache() {
 	}
 
 	combined := []v4api.QueryFilter{}
+	nativeValues := filterValueMap{}
 
 	// combine filter lists for each filter ID
 	for _, filterID := range filterOrder {
@@ -132,6 +204,8 @@ func (f *filterCache) refreshCache() {
 		bucketSort := ""
 
 		valuesMap := make(map[string]int)
+		// lower case global value -> value as shown
+		shownValues := make(map[string]string)
 
 		for _, filter := range filterList {
 			queryFilter.Sources = append(queryFilter.Sources, filter.source)
@@ -151,7 +225,13 @@ func (f *filterCache) refreshCache() {
 
 			// accumulate counts for specific values
 			for _, bucket := range filter.filter.Buckets {
-				valuesMap[bucket.Value] += bucket.Count
+				value := normalizer.global(filterID, filter.source, bucket.Value)
+				key := strings.ToLower(value)
+				if _, ok := shownValues[key]; ok == false {
+					shownValues[key] = value
+				}
+				valuesMap[shownValues[key]] += bucket.Count
+				nativeValues.set(filterID, filter.source, shownValues[key], bucket.Value)
 			}
 		}
 
@@ -193,26 +273,52 @@ func (f *filterCache) refreshCache() {
 		combined = append(combined, queryFilter)
 	}
 
-	f.combinedFilters = combined
+	return combined, nativeValues
+}
+
+// newFilterSnapshot builds a snapshot for the combined filters. If the filters are unchanged
+// from the prior snapshot, its version and modified time are kept
+func newFilterSnapshot(prior *filterSnapshot, sourceFilters map[string]*filterResponse, filters []v4api.QueryFilter) *filterSnapshot {
+	snapshot := filterSnapshot{sourceFilters: sourceFilters, filters: filters, modified: time.Now().UTC().Truncate(time.Second)}
+	filterJSON, _ := json.Marshal(filters)
+	sum := sha256.Sum256(filterJSON)
+	snapshot.version = hex.EncodeToString(sum[:8])
+	if prior != nil && prior.version == snapshot.version {
+		snapshot.modified = prior.modified
+	}
+	return &snapshot
+}
+
+// ages returns the time since the filters for each source were last updated
+func (f *filterCache) ages() map[string]time.Duration {
+	out := make(map[string]time.Duration)
+	for source, resp := range f.snapshot.Load().sourceFilters {
+		out[source] = time.Since(resp.updated)
+	}
+	return out
+}
+
+// getSnapshot returns the current filter snapshot
+func (f *filterCache) getSnapshot() *filterSnapshot {
+	return f.snapshot.Load()
 }
 
 func (f *filterCache) getFilters() []v4api.QueryFilter {
-	return f.combinedFilters
+	return f.snapshot.Load().filters
 }
 
 // GetSearchFilters will return all available advanced search filters
 func (svc *ServiceContext) GetSearchFilters(c *gin.Context) {
 	log.Printf("Get advanced search filters")
-	c.JSON(http.StatusOK, svc.FilterCache.getFilters())
+	snapshot := svc.FilterCache.getSnapshot()
+	if notModified(c, snapshot.version, snapshot.modified, snapshot.nextRefresh) {
+		return
+	}
+	c.JSON(http.StatusOK, snapshot.filters)
 }
 
-// Goroutine to do a pool pre-search filter lookup and return the results over a channel
-func (f *filterCache) getPoolFilters(pool *pool, channel chan *filterResponse, httpClient *http.Client) {
-	var method string
-	var endpoint string
-	var v4query []byte
-	var includeFilters map[string]bool
-
+// getPoolFilters does a pool pre-search filter lookup and returns the results
+func (f *filterCache) getPoolFilters(ctx context.Context, pool *pool, source *filterSource, httpClient *http.Client) *filterResponse {
 	chanResp := &filterResponse{pool: pool}
 
 	claims := v4jwt.V4Claims{IsUVA: true}
@@ -220,86 +326,53 @@ func (f *filterCache) getPoolFilters(pool *pool, channel chan *filterResponse, h
 	token, jwtErr := v4jwt.Mint(claims, 5*time.Minute, f.svc.JWTKey)
 	if jwtErr != nil {
 		log.Printf("[FILTERS] ERROR: failed to mint JWT: %s", jwtErr.Error())
-		channel <- chanResp
-		return
+		return chanResp
 	}
 
 	headers := map[string]string{
 		"Authorization": fmt.Sprintf("Bearer %s", token),
 	}
 
-	switch {
-	case pool.V4ID.Source == "eds":
+	// sources with a query POST it to the filters endpoint; the others GET it
+	method := "GET"
+	var v4query []byte
+	if source.Query != "" {
 		method = "POST"
-		endpoint = "api/search/facets"
-		v4query = []byte(`{"query":"keyword:{*}"}`)
+		v4query = []byte(source.Query)
 		headers["Content-Type"] = "application/json"
-		includeFilters = map[string]bool{
-			"ContentProvider":   true,
-			"SubjectGeographic": true,
-			"Language":          true,
-			"Publisher":         true,
-			"SourceType":        true,
-		}
-
-	case strings.HasPrefix(pool.V4ID.Source, "solr") == true:
-		method = "GET"
-		endpoint = "api/filters"
+	}
 
-	default:
-		log.Printf("[FILTERS] ERROR: unhandled pool source: [%s]", pool.V4ID.Source)
-		channel <- chanResp
-		return
+	if f.svc.Breakers.allow(pool.V4ID.ID) == false {
+		log.Printf("[FILTERS] WARNING: circuit breaker for %s is open; skipping filters", pool.V4ID.ID)
+		return chanResp
 	}
 
-	url := fmt.Sprintf("%s/%s", pool.PrivateURL, endpoint)
+	url := fmt.Sprintf("%s/%s", pool.PrivateURL, strings.TrimPrefix(source.Endpoint, "/"))
 
-	resp := serviceRequest(method, url, v4query, headers, httpClient)
+	resp := serviceRequest(ctx, method, url, v4query, headers, httpClient)
+	f.svc.Breakers.recordRequest(ctx, pool.V4ID.ID, resp.StatusCode)
 	if resp.StatusCode != http.StatusOK {
 		log.Printf("[FILTERS] ERROR: %s pool: http status code: %d", pool.V4ID.Source, resp.StatusCode)
-		channel <- chanResp
-		return
+		return chanResp
 	}
 
 	var filters v4api.PoolFacets
 	err := json.Unmarshal(resp.Response, &filters)
 	if err != nil {
 		log.Printf("[FILTERS] ERROR: %s pool: malformed response: %s", pool.V4ID.Source, err.Error())
-		channel <- chanResp
-		return
+		return chanResp
 	}
 
 	// ensure there are actually filters (the pools might send empty lists on error)
 	if len(filters.FacetList) == 0 {
 		log.Printf("[FILTERS] ERROR: %s pool: response contains no filters", pool.V4ID.Source)
-		channel <- chanResp
-		return
-	}
-
-	// if defined, only include specific filters
-	if len(includeFilters) > 0 {
-		var facets []v4api.Facet
-
-		for _, facet := range filters.FacetList {
-			if _, ok := includeFilters[facet.ID]; ok == true {
-				facets = append(facets, facet)
-			}
-		}
-
-		filters.FacetList = facets
+		return chanResp
 	}
 
-	// ensure filters are named appropriately
-	for i := range filters.FacetList {
-		facet := &filters.FacetList[i]
-
-		if strings.HasPrefix(facet.ID, "Filter") == false {
-			facet.ID = "Filter" + facet.ID
-		}
-	}
+	source.prepareFilters(&filters)
 
 	chanResp.filters = &filters
 	chanResp.updated = time.Now()
 
-	channel <- chanResp
+	return chanResp
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uvalib/virgo4-api/v4api"
+)
+
+func testFilters(values ...string) []v4api.QueryFilter {
+	filter := v4api.QueryFilter{ID: "FilterLanguage", Label: "Language", Sources: []string{"solr"}}
+	for i, value := range values {
+		filter.Values = append(filter.Values, v4api.QueryFilterValue{Value: value, Count: len(values) - i})
+	}
+	return []v4api.QueryFilter{filter}
+}
+
+func TestNewFilterSnapshot(t *testing.T) {
+	lastWeek := time.Now().UTC().Add(-7 * 24 * time.Hour).Truncate(time.Second)
+	prior := newFilterSnapshot(nil, map[string]*filterResponse{}, testFilters("English", "French"))
+	prior.modified = lastWeek
+
+	tests := []struct {
+		name         string
+		prior        *filterSnapshot
+		filters      []v4api.QueryFilter
+		wantVersion  bool
+		wantModified bool
+	}{
+		{name: "no prior snapshot", prior: nil, filters: testFilters("English", "French"), wantVersion: true},
+		{name: "unchanged filters", prior: prior, filters: testFilters("English", "French"),
+			wantVersion: true, wantModified: true},
+		{name: "changed values", prior: prior, filters: testFilters("English", "German")},
+		{name: "changed order", prior: prior, filters: testFilters("French", "English")},
+		{name: "no filters", prior: prior, filters: []v4api.QueryFilter{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snapshot := newFilterSnapshot(tt.prior, map[string]*filterResponse{}, tt.filters)
+			if snapshot.version == "" {
+				t.Fatalf("snapshot has no version")
+			}
+			if got := snapshot.version == prior.version; got != tt.wantVersion {
+				t.Errorf("version %s kept = %v, want %v", snapshot.version, got, tt.wantVersion)
+			}
+			if got := snapshot.modified.Equal(lastWeek); got != tt.wantModified {
+				t.Errorf("modified %s kept = %v, want %v", snapshot.modified, got, tt.wantModified)
+			}
+			if tt.wantModified == false && time.Since(snapshot.modified) > time.Minute {
+				t.Errorf("modified %s is not the time of the change", snapshot.modified)
+			}
+		})
+	}
+}
+
+func TestCarryOverFilters(t *testing.T) {
+	prior := newFilterSnapshot(nil, map[string]*filterResponse{
+		"solr":        {updated: time.Now()},
+		"solr-images": {updated: time.Now()},
+		"eds":         {updated: time.Now()},
+	}, []v4api.QueryFilter{})
+	sources := []*filterSource{{Source: "eds"}, {Source: "solr"}, {Source: "archives"}}
+
+	carried := carryOverFilters(prior, sources)
+	if len(carried) != 2 || carried["solr"] == nil || carried["eds"] == nil {
+		t.Errorf("carried filters for %v, want eds and solr", slices.Collect(maps.Keys(carried)))
+	}
+}
+
+// TestFilterCacheConcurrency publishes snapshots the way refreshCache does while requests
+// read them. Run with -race to check that readers only see complete snapshots
+func TestFilterCacheConcurrency(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	svc := &ServiceContext{}
+	svc.FilterCache = &filterCache{svc: svc, refreshInterval: 60}
+	initial := newFilterSnapshot(nil, map[string]*filterResponse{}, []v4api.QueryFilter{})
+	initial.sources = defaultFilterSources
+	initial.normalizer = newFilterNormalizer(nil)
+	initial.nativeValues = filterValueMap{}
+	svc.FilterCache.snapshot.Store(initial)
+
+	// the filters published with each version, to check responses against
+	var published sync.Map
+	filterJSON, _ := json.Marshal(initial.filters)
+	published.Store(initial.version, string(filterJSON))
+
+	const refreshes = 200
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(stop)
+		for i := 0; i < refreshes; i++ {
+			prior := svc.FilterCache.getSnapshot()
+			sourceFilters := make(map[string]*filterResponse)
+			for source, resp := range prior.sourceFilters {
+				sourceFilters[source] = resp
+			}
+			sourceFilters[fmt.Sprintf("source%d", i%5)] = &filterResponse{updated: time.Now()}
+
+			// every other refresh returns the same filters as the one before it
+			filters := testFilters("English", fmt.Sprintf("Language %d", i/2))
+			snapshot := newFilterSnapshot(prior, sourceFilters, filters)
+			snapshot.sources = prior.sources
+			snapshot.normalizer = prior.normalizer
+			snapshot.nativeValues = filterValueMap{}
+			snapshot.nextRefresh = time.Now().Add(time.Minute)
+			filterJSON, _ := json.Marshal(filters)
+			published.Store(snapshot.version, string(filterJSON))
+			svc.FilterCache.snapshot.Store(snapshot)
+		}
+	}()
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				snapshot := svc.FilterCache.getSnapshot()
+				if len(snapshot.filters) > 0 && len(snapshot.filters[0].Values) != 2 {
+					t.Errorf("snapshot %s has %d filter values", snapshot.version, len(snapshot.filters[0].Values))
+				}
+				for source, age := range svc.FilterCache.ages() {
+					if age < 0 || age > time.Minute {
+						t.Errorf("filters for %s are %s old", source, age)
+					}
+				}
+
+				w := httptest.NewRecorder()
+				c, _ := gin.CreateTestContext(w)
+				c.Request = httptest.NewRequest(http.MethodGet, "/api/filters", nil)
+				svc.GetSearchFilters(c)
+				if w.Code != http.StatusOK {
+					t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+					continue
+				}
+				var version string
+				fmt.Sscanf(w.Header().Get("ETag"), "%q", &version)
+				want, ok := published.Load(version)
+				if ok == false {
+					t.Errorf("ETag %s was never published", w.Header().Get("ETag"))
+				} else if w.Body.String() != want.(string) {
+					t.Errorf("filters for version %s = %s, want %s", version, w.Body.String(), want)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
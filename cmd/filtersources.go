@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/uvalib/virgo4-api/v4api"
+)
+
+// this is a struct that mirrors the V4DB filter_sources table. Each enabled row names a
+// pool source that supplies filters and how to request them. Sources with a query POST it
+// to the endpoint; the others GET it. If include_filters (a comma separated list of facet
+// IDs) is set, only those filters are used. Rows are used in sequence order
+type filterSource struct {
+	ID             int
+	Source         string
+	Endpoint       string
+	Query          string
+	IncludeFilters string
+	Sequence       int
+	Enabled        bool
+}
+
+// defaultFilterSources are used if the filter_sources table can't be read or is empty
+var defaultFilterSources = []*filterSource{
+	{Source: "solr", Endpoint: "api/filters", Sequence: 1, Enabled: true},
+	{Source: "solr-images", Endpoint: "api/filters", Sequence: 2, Enabled: true},
+	{Source: "eds", Endpoint: "api/search/facets", Query: `{"query":"keyword:{*}"}`,
+		IncludeFilters: "ContentProvider,SubjectGeographic,Language,Publisher,SourceType", Sequence: 3, Enabled: true},
+}
+
+// includeFilters returns the set of facet IDs to include, or nil if all are included
+func (fs *filterSource) includeFilters() map[string]bool {
+	ids := splitList(fs.IncludeFilters)
+	if len(ids) == 0 {
+		return nil
+	}
+	out := make(map[string]bool)
+	for _, id := range ids {
+		out[strings.TrimPrefix(id, "Filter")] = true
+	}
+	return out
+}
+
+// prepareFilters limits pool filters to the source include list (if any) and ensures the
+// filters are named appropriately
+func (fs *filterSource) prepareFilters(filters *v4api.PoolFacets) {
+	// if defined, only include specific filters
+	if includeFilters := fs.includeFilters(); len(includeFilters) > 0 {
+		var facets []v4api.Facet
+
+		for _, facet := range filters.FacetList {
+			if _, ok := includeFilters[strings.TrimPrefix(facet.ID, "Filter")]; ok == true {
+				facets = append(facets, facet)
+			}
+		}
+
+		filters.FacetList = facets
+	}
+
+	for i := range filters.FacetList {
+		facet := &filters.FacetList[i]
+
+		if strings.HasPrefix(facet.ID, "Filter") == false {
+			facet.ID = "Filter" + facet.ID
+		}
+	}
+}
+
+// lookupFilterSources reads the enabled filter sources in order of preference
+func (f *filterCache) lookupFilterSources() []*filterSource {
+	var sources []*filterSource
+	dbResp := f.svc.GDB.Where("enabled=?", true).Order("sequence asc").Find(&sources)
+	if dbResp.Error != nil {
+		log.Printf("[FILTERS] WARNING: Unable to get filter sources; using defaults: %s", dbResp.Error.Error())
+		return defaultFilterSources
+	}
+	if len(sources) == 0 {
+		log.Printf("[FILTERS] WARNING: No filter sources configured; using defaults")
+		return defaultFilterSources
+	}
+	for _, source := range sources {
+		if source.Endpoint == "" {
+			source.Endpoint = "api/filters"
+		}
+	}
+	return sources
+}
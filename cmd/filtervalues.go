@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/uvalib/virgo4-api/v4api"
+)
+
+// this is a struct that mirrors the V4DB filter_value_mappings table. Each row maps the
+// native value a source uses for a filter (e.g. the eds language "eng") to the global value
+// shown to clients (e.g. "English"). An empty source applies to all sources
+type filterValueMapping struct {
+	ID         int
+	FilterID   string
+	Source     string
+	Value      string
+	Normalized string
+}
+
+// filterNormalizer converts filter values between the native values of each source and the
+// global values. Native values are matched without regard to case
+type filterNormalizer struct {
+	// lower case native value -> global value
+	toGlobal filterValueMap
+	// global value -> native value
+	toNative filterValueMap
+}
+
+// filterValueMap maps filter values for each filter ID and source:
+// filter ID -> source -> value -> mapped value
+type filterValueMap map[string]map[string]map[string]string
+
+// set adds a mapping; the first mapping of a value wins
+func (nv filterValueMap) set(filterID string, source string, value string, mapped string) {
+	if nv[filterID] == nil {
+		nv[filterID] = make(map[string]map[string]string)
+	}
+	if nv[filterID][source] == nil {
+		nv[filterID][source] = make(map[string]string)
+	}
+	if _, ok := nv[filterID][source][value]; ok == false {
+		nv[filterID][source][value] = mapped
+	}
+}
+
+func newFilterNormalizer(mappings []*filterValueMapping) *filterNormalizer {
+	norm := filterNormalizer{toGlobal: filterValueMap{}, toNative: filterValueMap{}}
+	for _, m := range mappings {
+		filterID := m.FilterID
+		if strings.HasPrefix(filterID, "Filter") == false {
+			filterID = "Filter" + filterID
+		}
+		norm.toGlobal.set(filterID, m.Source, strings.ToLower(m.Value), m.Normalized)
+		norm.toNative.set(filterID, m.Source, m.Normalized, m.Value)
+	}
+	return &norm
+}
+
+// lookupFilterValueMappings reads the filter value mappings. If they can't be read, values
+// are only case folded
+func (f *filterCache) lookupFilterValueMappings() *filterNormalizer {
+	var mappings []*filterValueMapping
+	dbResp := f.svc.GDB.Order("id asc").Find(&mappings)
+	if dbResp.Error != nil {
+		log.Printf("[FILTERS] WARNING: Unable to get filter value mappings: %s", dbResp.Error.Error())
+		return newFilterNormalizer(nil)
+	}
+	log.Printf("[FILTERS] loaded %d filter value mappings", len(mappings))
+	return newFilterNormalizer(mappings)
+}
+
+// mapping returns the mapped value for a source, falling back to a mapping for all sources
+func mapping(values map[string]map[string]string, source string, value string) (string, bool) {
+	if mapped, ok := values[source][value]; ok {
+		return mapped, true
+	}
+	mapped, ok := values[""][value]
+	return mapped, ok
+}
+
+// global returns the global value for a native filter value from a source
+func (n *filterNormalizer) global(filterID string, source string, value string) string {
+	if mapped, ok := mapping(n.toGlobal[filterID], source, strings.ToLower(value)); ok {
+		return mapped
+	}
+	return value
+}
+
+// native returns the value a source uses for a global filter value. Values seen from the
+// source when the filters were last merged are preferred over the configured mappings
+func (s *filterSnapshot) native(filterID string, source string, value string) string {
+	if native, ok := s.nativeValues[filterID][source][value]; ok {
+		return native
+	}
+	if native, ok := mapping(s.normalizer.toNative[filterID], source, value); ok {
+		return native
+	}
+	return value
+}
+
+// supports returns true if the filter was provided by the source
+func (s *filterSnapshot) supports(filterID string, source string) bool {
+	for _, filter := range s.filters {
+		if filter.ID == filterID {
+			return slices.Contains(filter.Sources, source)
+		}
+	}
+	return false
+}
+
+// checkGlobalFilters returns the error response for a request with global filters that can't
+// be applied: a 503 if the filters have not been loaded yet, or a 400 for filter IDs that are
+// not in the merged filters. The error is nil if the global filters can be applied
+func checkGlobalFilters(req *clientSearchRequest, snapshot *filterSnapshot) (int, *searchError) {
+	if len(req.GlobalFilters) == 0 {
+		return http.StatusOK, nil
+	}
+	if len(snapshot.filters) == 0 {
+		return http.StatusServiceUnavailable, &searchError{Message: "Filters are not available yet. Please try again later.",
+			Details: "global filters can't be applied until the filters have been loaded"}
+	}
+	unknown := make([]string, 0)
+	for _, gf := range req.GlobalFilters {
+		known := slices.ContainsFunc(snapshot.filters, func(filter v4api.QueryFilter) bool { return filter.ID == gf.FacetID })
+		if known == false && slices.Contains(unknown, gf.FacetID) == false {
+			unknown = append(unknown, gf.FacetID)
+		}
+	}
+	if len(unknown) > 0 {
+		return http.StatusBadRequest, &searchError{Message: "This query is malformed or unsupported.",
+			Details: fmt.Sprintf("unknown global filters: %s", strings.Join(unknown, ", "))}
+	}
+	return http.StatusOK, nil
+}
+
+// unsupportedFilters returns the labels of the global filters in the request that the pool
+// source does not support
+func unsupportedFilters(req *clientSearchRequest, pool *pool, snapshot *filterSnapshot) []string {
+	out := make([]string, 0)
+	for _, gf := range req.GlobalFilters {
+		if snapshot.supports(gf.FacetID, pool.V4ID.Source) {
+			continue
+		}
+		label := gf.FacetID
+		for _, filter := range snapshot.filters {
+			if filter.ID == gf.FacetID && filter.Label != "" {
+				label = filter.Label
+			}
+		}
+		if slices.Contains(out, label) == false {
+			out = append(out, label)
+		}
+	}
+	return out
+}
+
+// poolFilters returns the filter group for the pool: the group from the request that applies
+// to the pool, if any, along with the global filters the pool source supports. Filter values
+// are translated to the values native to the pool source
+func poolFilters(req *clientSearchRequest, pool *pool, snapshot *filterSnapshot) []v4api.Filter {
+	group := v4api.Filter{PoolID: pool.V4ID.ID}
+	found := false
+	for _, filterGroup := range req.Filters {
+		if filterGroup.PoolID == pool.V4ID.ID {
+			// copy the facets; the request is shared by all of the pool searches
+			group.Facets = append(filterGroup.Facets[:0:0], filterGroup.Facets...)
+			found = true
+			break
+		}
+	}
+	for _, gf := range req.GlobalFilters {
+		if snapshot.supports(gf.FacetID, pool.V4ID.Source) == false {
+			continue
+		}
+		dup := false
+		for _, facet := range group.Facets {
+			dup = dup || (facet.FacetID == gf.FacetID && facet.Value == gf.Value)
+		}
+		if dup == false {
+			group.Facets = append(group.Facets, gf)
+		}
+	}
+	if found == false && len(group.Facets) == 0 {
+		return []v4api.Filter{}
+	}
+
+	for i := range group.Facets {
+		facet := &group.Facets[i]
+		facet.Value = snapshot.native(facet.FacetID, pool.V4ID.Source, facet.Value)
+	}
+	return []v4api.Filter{group}
+}
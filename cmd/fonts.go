@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"unicode"
+
+	"github.com/signintech/gopdf"
+	"github.com/signintech/gopdf/fontmaker/core"
+)
+
+// Font styles used when rendering PDFs. The primary font in the chain is registered
+// with these names; fallback fonts get an index suffix
+const (
+	fontRegular = "osr"
+	fontBold    = "osb"
+)
+
+// pdfFont is one font family in the fallback chain
+type pdfFont struct {
+	family  string
+	regular []byte
+	bold    []byte
+	chars   map[int]uint
+}
+
+// fontChain is an ordered list of font families. Text is rendered with the first
+// family in the chain that has a glyph for each character
+type fontChain struct {
+	fonts []*pdfFont
+}
+
+// loadFontChain finds and parses each font family in the configured font directories.
+// Families are loaded from <family>-Regular.ttf (or <family>.ttf) and an optional
+// <family>-Bold.ttf. Missing fallback families are skipped, but the first family is required
+func loadFontChain(dirs []string, families []string) (*fontChain, error) {
+	chain := fontChain{}
+	for idx, family := range families {
+		regular := findFontFile(dirs, fmt.Sprintf("%s-Regular.ttf", family), fmt.Sprintf("%s.ttf", family))
+		if regular == "" {
+			if idx == 0 {
+				return nil, fmt.Errorf("primary font %s not found in %v", family, dirs)
+			}
+			log.Printf("WARNING: fallback font %s not found in %v; skipping", family, dirs)
+			continue
+		}
+
+		font := pdfFont{family: family}
+		var err error
+		font.regular, err = os.ReadFile(regular)
+		if err != nil {
+			return nil, err
+		}
+		parser := core.TTFParser{}
+		if err := parser.ParseFontData(font.regular); err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %s", regular, err.Error())
+		}
+		font.chars = parser.Chars()
+
+		font.bold = font.regular
+		if bold := findFontFile(dirs, fmt.Sprintf("%s-Bold.ttf", family)); bold != "" {
+			font.bold, err = os.ReadFile(bold)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		log.Printf("INFO: loaded PDF font %s with %d glyphs", family, len(font.chars))
+		chain.fonts = append(chain.fonts, &font)
+	}
+	return &chain, nil
+}
+
+// findFontFile returns the path of the first of the font file names found in the font
+// directories. Each directory is searched along with its subdirectories, so system font
+// directories can be given without knowing how the font packages lay them out
+func findFontFile(dirs []string, names ...string) string {
+	for _, name := range names {
+		for _, dir := range dirs {
+			found := ""
+			filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return nil
+				}
+				if d.IsDir() == false && d.Name() == name {
+					found = path
+					return fs.SkipAll
+				}
+				return nil
+			})
+			if found != "" {
+				return found
+			}
+		}
+	}
+	return ""
+}
+
+// addTo registers every font in the chain with the PDF
+func (fc *fontChain) addTo(pdf *gopdf.GoPdf) error {
+	for idx, font := range fc.fonts {
+		if err := pdf.AddTTFFontData(fc.fontName(idx, fontRegular), font.regular); err != nil {
+			return fmt.Errorf("unable to add %s: %s", font.family, err.Error())
+		}
+		if err := pdf.AddTTFFontData(fc.fontName(idx, fontBold), font.bold); err != nil {
+			return fmt.Errorf("unable to add %s bold: %s", font.family, err.Error())
+		}
+	}
+	return nil
+}
+
+// fontName returns the PDF font name for the font at index idx in the chain
+func (fc *fontChain) fontName(idx int, style string) string {
+	if idx == 0 {
+		return style
+	}
+	return fmt.Sprintf("%s-%d", style, idx)
+}
+
+// fontIndex returns the index of the first font in the chain that can render the rune
+func (fc *fontChain) fontIndex(r rune) int {
+	for idx, font := range fc.fonts {
+		if _, ok := font.chars[int(r)]; ok {
+			return idx
+		}
+	}
+	return 0
+}
+
+// fontRun is a piece of text that is rendered with a single font
+type fontRun struct {
+	font string
+	text string
+}
+
+// fontRuns splits text into runs that can each be rendered with one font from the chain.
+// Spaces and combining marks stay with the run they follow
+func (fc *fontChain) fontRuns(text string, style string) []fontRun {
+	runs := make([]fontRun, 0)
+	current := -1
+	start := 0
+	runes := []rune(text)
+	for i, r := range runes {
+		idx := fc.fontIndex(r)
+		if current >= 0 && (unicode.IsSpace(r) || unicode.Is(unicode.Mn, r)) {
+			idx = current
+		}
+		if idx != current {
+			if current >= 0 {
+				runs = append(runs, fontRun{font: fc.fontName(current, style), text: string(runes[start:i])})
+			}
+			current = idx
+			start = i
+		}
+	}
+	if current >= 0 {
+		runs = append(runs, fontRun{font: fc.fontName(current, style), text: string(runes[start:])})
+	}
+	return runs
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// exportFormat describes an output format supported by the bookmark export
+type exportFormat struct {
+	ContentType string
+	FileName    string
+	Write       func(w io.Writer, details []*itemDetail, opts *exportOptions) error
+}
+
+// exportOptions contains everything other than the item details needed to write an export
+type exportOptions struct {
+	Title   string
+	Notes   string
+	BaseURL string
+	Columns []exportColumn
+	Failed  []*itemDetail
+}
+
+// exportFormats are all of the supported export formats, keyed by the format param
+var exportFormats = map[string]exportFormat{
+	"xlsx":    {ContentType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", FileName: "bookmarks.xlsx", Write: writeExcel},
+	"csv":     {ContentType: "text/csv", FileName: "bookmarks.csv", Write: writeCSV},
+	"ris":     {ContentType: "application/x-research-info-systems", FileName: "bookmarks.ris", Write: writeRIS},
+	"bibtex":  {ContentType: "application/x-bibtex", FileName: "bookmarks.bib", Write: writeBibTeX},
+	"endnote": {ContentType: "application/xml", FileName: "bookmarks-endnote.xml", Write: writeEndNoteXML},
+	"marcxml": {ContentType: "application/marcxml+xml", FileName: "bookmarks-marc.xml", Write: writeMARCXML},
+}
+
+var yearRegex = regexp.MustCompile(`\d{4}`)
+
+// itemURL returns the full client URL for the item details page
+func itemURL(baseURL string, item *itemDetail) string {
+	return fmt.Sprintf("%s/sources/%s/items/%s", baseURL, item.Pool, item.Identifier)
+}
+
+// itemYear returns the first four digit year found in the item date
+func itemYear(item *itemDetail) string {
+	return yearRegex.FindString(item.Date)
+}
+
+func writeCSV(w io.Writer, details []*itemDetail, opts *exportOptions) error {
+	cw := csv.NewWriter(w)
+	csvHead := make([]string, 0, len(opts.Columns))
+	for _, col := range opts.Columns {
+		csvHead = append(csvHead, strings.ToLower(col.Label))
+	}
+	cw.Write(csvHead)
+	for _, item := range details {
+		line := make([]string, 0, len(opts.Columns))
+		for _, col := range opts.Columns {
+			line = append(line, col.Value(item, opts.BaseURL))
+		}
+		cw.Write(line)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// risType maps a V4 format to the matching RIS reference type
+func risType(item *itemDetail) string {
+	for _, f := range item.Format {
+		switch strings.ToLower(f) {
+		case "book", "ebook":
+			return "BOOK"
+		case "journal/magazine", "journal", "periodical", "online journal":
+			return "JOUR"
+		case "video", "dvd", "blu-ray", "streaming video":
+			return "VIDEO"
+		case "sound recording", "musical recording", "cd", "audio":
+			return "SOUND"
+		case "map":
+			return "MAP"
+		case "musical score":
+			return "MUSIC"
+		case "thesis/dissertation", "thesis", "dissertation":
+			return "THES"
+		case "manuscript":
+			return "MANSCPT"
+		}
+	}
+	return "GEN"
+}
+
+func writeRIS(w io.Writer, details []*itemDetail, opts *exportOptions) error {
+	for _, item := range details {
+		lines := []string{fmt.Sprintf("TY  - %s", risType(item))}
+		for _, t := range item.Title {
+			lines = append(lines, fmt.Sprintf("TI  - %s", t))
+		}
+		for _, a := range item.Author {
+			lines = append(lines, fmt.Sprintf("AU  - %s", a))
+		}
+		if year := itemYear(item); year != "" {
+			lines = append(lines, fmt.Sprintf("PY  - %s", year))
+		}
+		for _, pb := range item.Fields["publisher_name"] {
+			lines = append(lines, fmt.Sprintf("PB  - %s", pb))
+		}
+		for _, ed := range item.Fields["edition"] {
+			lines = append(lines, fmt.Sprintf("ET  - %s", ed))
+		}
+		for _, sn := range append(append([]string{}, item.Fields["isbn"]...), item.Fields["issn"]...) {
+			lines = append(lines, fmt.Sprintf("SN  - %s", sn))
+		}
+		for _, kw := range item.Fields["subject"] {
+			lines = append(lines, fmt.Sprintf("KW  - %s", kw))
+		}
+		for _, cn := range item.CallNumber {
+			lines = append(lines, fmt.Sprintf("CN  - %s", cn))
+		}
+		for _, l := range item.Library {
+			lines = append(lines, fmt.Sprintf("AV  - %s", l))
+		}
+		lines = append(lines, fmt.Sprintf("UR  - %s", itemURL(opts.BaseURL, item)))
+		lines = append(lines, fmt.Sprintf("ID  - %s", item.Identifier))
+		lines = append(lines, "ER  - ", "")
+		if _, err := io.WriteString(w, strings.Join(lines, "\r\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var bibKeyRegex = regexp.MustCompile(`[^A-Za-z0-9_:-]`)
+
+// bibEscape escapes characters that are special to BibTeX
+func bibEscape(val string) string {
+	r := strings.NewReplacer(`\`, `\textbackslash{}`, "{", `\{`, "}", `\}`, "&", `\&`, "%", `\%`, "$", `\$`, "#", `\#`, "_", `\_`)
+	return r.Replace(val)
+}
+
+func writeBibTeX(w io.Writer, details []*itemDetail, opts *exportOptions) error {
+	for _, item := range details {
+		entryType := "misc"
+		switch risType(item) {
+		case "BOOK":
+			entryType = "book"
+		case "JOUR":
+			entryType = "periodical"
+		case "THES":
+			entryType = "phdthesis"
+		}
+
+		fields := make([]string, 0)
+		addField := func(name string, val string) {
+			if val != "" {
+				fields = append(fields, fmt.Sprintf("  %s = {%s}", name, bibEscape(val)))
+			}
+		}
+		addField("title", strings.Join(item.Title, "; "))
+		addField("author", strings.Join(item.Author, " and "))
+		addField("year", itemYear(item))
+		addField("publisher", strings.Join(item.Fields["publisher_name"], "; "))
+		addField("edition", strings.Join(item.Fields["edition"], "; "))
+		addField("isbn", strings.Join(item.Fields["isbn"], ", "))
+		addField("issn", strings.Join(item.Fields["issn"], ", "))
+		addField("note", strings.Join(item.CallNumber, "; "))
+		addField("howpublished", strings.Join(item.Format, "; "))
+		fields = append(fields, fmt.Sprintf("  url = {%s}", itemURL(opts.BaseURL, item)))
+
+		key := bibKeyRegex.ReplaceAllString(item.Identifier, "_")
+		entry := fmt.Sprintf("@%s{%s,\n%s\n}\n\n", entryType, key, strings.Join(fields, ",\n"))
+		if _, err := io.WriteString(w, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type endNoteXML struct {
+	XMLName xml.Name        `xml:"xml"`
+	Records []endNoteRecord `xml:"records>record"`
+}
+
+type endNoteRefType struct {
+	Name  string `xml:"name,attr"`
+	Value int    `xml:",chardata"`
+}
+
+type endNoteRecord struct {
+	RefType  endNoteRefType `xml:"ref-type"`
+	Authors  []string       `xml:"contributors>authors>author"`
+	Titles   []string       `xml:"titles>title"`
+	Year     string         `xml:"dates>year,omitempty"`
+	CallNum  string         `xml:"call-num,omitempty"`
+	Location string         `xml:"library,omitempty"`
+	WorkType string         `xml:"work-type,omitempty"`
+	URLs     []string       `xml:"urls>related-urls>url"`
+	Label    string         `xml:"label"`
+}
+
+// endNoteRefTypes maps RIS types onto EndNote reference type names and numbers
+var endNoteRefTypes = map[string]endNoteRefType{
+	"BOOK":    {Name: "Book", Value: 6},
+	"JOUR":    {Name: "Journal Article", Value: 17},
+	"VIDEO":   {Name: "Film or Broadcast", Value: 21},
+	"SOUND":   {Name: "Audiovisual Material", Value: 3},
+	"MAP":     {Name: "Map", Value: 20},
+	"MUSIC":   {Name: "Music", Value: 61},
+	"THES":    {Name: "Thesis", Value: 32},
+	"MANSCPT": {Name: "Manuscript", Value: 36},
+	"GEN":     {Name: "Generic", Value: 13},
+}
+
+func writeEndNoteXML(w io.Writer, details []*itemDetail, opts *exportOptions) error {
+	doc := endNoteXML{}
+	for _, item := range details {
+		rec := endNoteRecord{
+			RefType:  endNoteRefTypes[risType(item)],
+			Authors:  item.Author,
+			Titles:   item.Title,
+			Year:     itemYear(item),
+			CallNum:  strings.Join(item.CallNumber, "; "),
+			Location: strings.Join(append(append([]string{}, item.Library...), item.Location...), "; "),
+			WorkType: strings.Join(item.Format, "; "),
+			URLs:     []string{itemURL(opts.BaseURL, item)},
+			Label:    item.Identifier,
+		}
+		doc.Records = append(doc.Records, rec)
+	}
+	return writeXML(w, doc)
+}
+
+type marcCollection struct {
+	XMLName xml.Name     `xml:"http://www.loc.gov/MARC21/slim collection"`
+	Records []marcRecord `xml:"record"`
+}
+
+type marcRecord struct {
+	Leader        string          `xml:"leader"`
+	ControlFields []marcControl   `xml:"controlfield"`
+	DataFields    []marcDataField `xml:"datafield"`
+}
+
+type marcControl struct {
+	Tag   string `xml:"tag,attr"`
+	Value string `xml:",chardata"`
+}
+
+type marcDataField struct {
+	Tag       string         `xml:"tag,attr"`
+	Ind1      string         `xml:"ind1,attr"`
+	Ind2      string         `xml:"ind2,attr"`
+	Subfields []marcSubfield `xml:"subfield"`
+}
+
+type marcSubfield struct {
+	Code  string `xml:"code,attr"`
+	Value string `xml:",chardata"`
+}
+
+func marcField(tag string, ind1 string, ind2 string, subfields ...string) marcDataField {
+	df := marcDataField{Tag: tag, Ind1: ind1, Ind2: ind2}
+	for i := 0; i+1 < len(subfields); i += 2 {
+		df.Subfields = append(df.Subfields, marcSubfield{Code: subfields[i], Value: subfields[i+1]})
+	}
+	return df
+}
+
+func writeMARCXML(w io.Writer, details []*itemDetail, opts *exportOptions) error {
+	doc := marcCollection{}
+	for _, item := range details {
+		rec := marcRecord{Leader: "00000nam a2200000 a 4500"}
+		rec.ControlFields = append(rec.ControlFields, marcControl{Tag: "001", Value: item.Identifier})
+		for _, cn := range item.CallNumber {
+			rec.DataFields = append(rec.DataFields, marcField("099", " ", "9", "a", cn))
+		}
+		if len(item.Author) > 0 {
+			rec.DataFields = append(rec.DataFields, marcField("100", "1", " ", "a", item.Author[0]))
+		}
+		for idx, t := range item.Title {
+			tag := "246"
+			if idx == 0 {
+				tag = "245"
+			}
+			rec.DataFields = append(rec.DataFields, marcField(tag, "0", "0", "a", t))
+		}
+		if item.Date != "" {
+			rec.DataFields = append(rec.DataFields, marcField("264", " ", "1", "c", item.Date))
+		}
+		for _, f := range item.Format {
+			rec.DataFields = append(rec.DataFields, marcField("380", " ", " ", "a", f))
+		}
+		if len(item.Author) > 1 {
+			for _, a := range item.Author[1:] {
+				rec.DataFields = append(rec.DataFields, marcField("700", "1", " ", "a", a))
+			}
+		}
+		for idx, lib := range item.Library {
+			holding := []string{"b", lib}
+			if idx < len(item.Location) {
+				holding = append(holding, "c", item.Location[idx])
+			}
+			rec.DataFields = append(rec.DataFields, marcField("852", " ", " ", holding...))
+		}
+		rec.DataFields = append(rec.DataFields, marcField("856", "4", " ", "u", itemURL(opts.BaseURL, item)))
+		doc.Records = append(doc.Records, rec)
+	}
+	return writeXML(w, doc)
+}
+
+func writeXML(w io.Writer, doc interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	return enc.Flush()
+}
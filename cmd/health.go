@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	healthOK        = "ok"
+	healthDegraded  = "degraded"
+	healthUnhealthy = "unhealthy"
+)
+
+type hcResp struct {
+	Healthy   bool   `json:"healthy"`
+	Status    string `json:"status,omitempty"`
+	Message   string `json:"message,omitempty"`
+	LatencyMS int64  `json:"latency_ms,omitempty"`
+	AgeSec    int    `json:"age_sec,omitempty"`
+	Breaker   string `json:"breaker,omitempty"`
+}
+
+type poolHealth struct {
+	Name   string
+	Health hcResp
+}
+
+// HealthCheck reports the health of the serivce. This includes the V4 DB, the /identify
+// response of every enabled pool and the age of the filter cache. An overall verdict
+// is reported in the "service" entry
+func (svc *ServiceContext) HealthCheck(c *gin.Context) {
+	hcMap := make(map[string]hcResp)
+	verdict := healthOK
+
+	var sources []*source
+	dbResp := svc.GDB.Where("enabled=?", true).Order("sequence asc").Find(&sources)
+	if dbResp.Error != nil {
+		log.Printf("ERROR: Failed response from PSQL healthcheck: %s", dbResp.Error.Error())
+		hcMap["postgres"] = hcResp{Healthy: false, Status: healthUnhealthy, Message: dbResp.Error.Error()}
+		verdict = healthUnhealthy
+	} else {
+		hcMap["postgres"] = hcResp{Healthy: true, Status: healthOK}
+	}
+
+	breakers := svc.Breakers.states()
+	downPools := 0
+	fanOut(c.Request.Context(), "health", len(sources), func(ctx context.Context, idx int) *poolHealth {
+		return svc.checkPool(ctx, sources[idx])
+	}, func(idx int, err error) *poolHealth {
+		return &poolHealth{Name: sources[idx].Name, Health: hcResp{Status: healthDegraded, Message: err.Error()}}
+	}, func(idx int, ph *poolHealth) {
+		ph.Health.Breaker = breakers[ph.Name]
+		if ph.Health.Breaker == breakerOpen.String() {
+			ph.Health.Healthy = false
+			ph.Health.Status = healthDegraded
+		}
+		if ph.Health.Healthy == false {
+			downPools++
+		}
+		if ph.Health.Status != healthOK && verdict == healthOK {
+			verdict = healthDegraded
+		}
+		hcMap[fmt.Sprintf("pool-%s", ph.Name)] = ph.Health
+	})
+
+	if len(sources) > 0 && (downPools == len(sources) || downPools >= svc.Health.MaxDownPools) {
+		verdict = healthUnhealthy
+	}
+
+	for source, age := range svc.FilterCache.ages() {
+		fh := hcResp{Healthy: true, Status: healthOK, AgeSec: int(age.Seconds())}
+		if fh.AgeSec > svc.Health.FilterAgeSec {
+			fh.Healthy = false
+			fh.Status = healthDegraded
+			fh.Message = fmt.Sprintf("filters not updated in %d seconds", fh.AgeSec)
+			if verdict == healthOK {
+				verdict = healthDegraded
+			}
+		}
+		hcMap[fmt.Sprintf("filters-%s", source)] = fh
+	}
+
+	hcMap["service"] = hcResp{Healthy: verdict != healthUnhealthy, Status: verdict}
+	c.JSON(http.StatusOK, hcMap)
+}
+
+// checkPool checks that a pool responds to /identify and returns the results
+func (svc *ServiceContext) checkPool(ctx context.Context, src *source) *poolHealth {
+	url := fmt.Sprintf("%s/identify", src.PrivateURL)
+	resp := serviceRequest(ctx, "GET", url, nil, nil, svc.FastHTTPClient)
+	out := poolHealth{Name: src.Name}
+	out.Health.LatencyMS = resp.ElapsedMS
+	if resp.StatusCode != http.StatusOK {
+		out.Health.Status = healthDegraded
+		out.Health.Message = string(resp.Response)
+		return &out
+	}
+
+	out.Health.Healthy = true
+	out.Health.Status = healthOK
+	if resp.ElapsedMS > svc.Health.SlowMS {
+		out.Health.Status = healthDegraded
+		out.Health.Message = fmt.Sprintf("identify took %d ms", resp.ElapsedMS)
+	}
+	return &out
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uvalib/virgo4-jwt/v4jwt"
+	"gorm.io/gorm"
+)
+
+const (
+	jobPending  = "pending"
+	jobRunning  = "running"
+	jobComplete = "complete"
+	jobFailed   = "failed"
+)
+
+// exportJob is an asynchronous bookmark export or PDF. Jobs and their finished
+// artifacts are stored in the export_jobs table until they expire
+type exportJob struct {
+	ID          string     `gorm:"primaryKey;size:32" json:"id"`
+	UserID      string     `gorm:"index" json:"-"`
+	Type        string     `json:"type"`
+	Format      string     `json:"format"`
+	Status      string     `gorm:"index" json:"status"`
+	Total       int        `json:"total"`
+	Fetched     int        `json:"fetched"`
+	Failed      int        `json:"failed"`
+	Message     string     `json:"message,omitempty"`
+	ContentType string     `json:"-"`
+	FileName    string     `json:"file_name,omitempty"`
+	Result      []byte     `json:"-"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   time.Time  `gorm:"index" json:"expires_at"`
+	DownloadURL string     `gorm:"-" json:"download_url,omitempty"`
+}
+
+// jobStore manages the export jobs table. Finished jobs are kept for the retention
+// window; jobs that stop making progress (for example, because the instance running
+// them restarted) are marked as failed. Jobs fetch item details with a token minted
+// from the submitter's claims that is good for tokenLifetime; items still being fetched
+// when it expires are reported as failed
+type jobStore struct {
+	svc           *ServiceContext
+	retention     time.Duration
+	staleTime     time.Duration
+	tokenLifetime time.Duration
+}
+
+// newJobStore ensures the export jobs table exists and starts the expired job cleanup
+func newJobStore(svc *ServiceContext, retentionMins int) (*jobStore, error) {
+	if err := svc.GDB.AutoMigrate(&exportJob{}); err != nil {
+		return nil, err
+	}
+	js := jobStore{svc: svc, retention: time.Duration(retentionMins) * time.Minute, staleTime: 30 * time.Minute,
+		tokenLifetime: 4 * time.Hour}
+	go js.cleanup()
+	return &js, nil
+}
+
+func (js *jobStore) cleanup() {
+	for {
+		now := time.Now()
+		resp := js.svc.GDB.Where("expires_at < ?", now).Delete(&exportJob{})
+		if resp.Error != nil {
+			log.Printf("ERROR: unable to remove expired export jobs: %s", resp.Error.Error())
+		} else if resp.RowsAffected > 0 {
+			log.Printf("INFO: removed %d expired export jobs", resp.RowsAffected)
+		}
+
+		resp = js.svc.GDB.Model(&exportJob{}).
+			Where("status in ? and updated_at < ?", []string{jobPending, jobRunning}, now.Add(-js.staleTime)).
+			Updates(map[string]interface{}{"status": jobFailed, "message": "export job stopped responding",
+				"completed_at": now, "expires_at": now.Add(js.retention)})
+		if resp.Error != nil {
+			log.Printf("ERROR: unable to fail stale export jobs: %s", resp.Error.Error())
+		} else if resp.RowsAffected > 0 {
+			log.Printf("WARNING: marked %d stale export jobs as failed", resp.RowsAffected)
+		}
+		time.Sleep(5 * time.Minute)
+	}
+}
+
+// newJobID returns a random, unguessable job identifier
+func newJobID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// jobClaims returns the JWT claims of the user making the request
+func jobClaims(c *gin.Context) *v4jwt.V4Claims {
+	val, ok := c.Get("claims")
+	if ok == false {
+		return &v4jwt.V4Claims{}
+	}
+	return val.(*v4jwt.V4Claims)
+}
+
+// jobUserID returns the ID of the user making the request, from the JWT claims
+func jobUserID(c *gin.Context) string {
+	return jobClaims(c).UserID
+}
+
+// SubmitExportJob accepts the same request as ExportBookmarks and starts an asynchronous
+// export. The format query param selects the export format
+func (svc *ServiceContext) SubmitExportJob(c *gin.Context) {
+	format := strings.ToLower(c.DefaultQuery("format", "xlsx"))
+	var req exportRequest
+	if err := c.BindJSON(&req); err != nil {
+		log.Printf("ERROR: Unable to parse export job request: %s", err.Error())
+		c.String(http.StatusBadRequest, "Invalid export request")
+		return
+	}
+
+	fmtInfo, baseURL, err := svc.validateExport(&req, format)
+	if err != nil {
+		log.Printf("ERROR: Invalid export job request: %s", err.Error())
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	job := &exportJob{Type: "export", Format: format, ContentType: fmtInfo.ContentType, FileName: fmtInfo.FileName}
+	svc.submitJob(c, job, &req, func(buf *bytes.Buffer, details []*itemDetail, failed []*itemDetail) error {
+		return writeExport(buf, fmtInfo, &req, baseURL, details, failed)
+	})
+}
+
+// SubmitPDFJob accepts the same request as GeneratePDF and starts an asynchronous PDF export
+func (svc *ServiceContext) SubmitPDFJob(c *gin.Context) {
+	var req exportRequest
+	if err := c.BindJSON(&req); err != nil {
+		log.Printf("ERROR: Unable to parse PDF job request: %s", err.Error())
+		c.String(http.StatusBadRequest, "Invalid PDF request")
+		return
+	}
+
+	baseURL, layout, err := svc.validatePDF(&req)
+	if err != nil {
+		log.Printf("ERROR: Invalid PDF job request: %s", err.Error())
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	job := &exportJob{Type: "pdf", Format: "pdf", ContentType: "application/pdf", FileName: "results.pdf"}
+	svc.submitJob(c, job, &req, func(buf *bytes.Buffer, details []*itemDetail, failed []*itemDetail) error {
+		return svc.writePDF(buf, &req, layout, baseURL, details, failed)
+	})
+}
+
+// submitJob saves a new job and starts it running. The job status is returned with a 202
+func (svc *ServiceContext) submitJob(c *gin.Context, job *exportJob, req *exportRequest,
+	write func(buf *bytes.Buffer, details []*itemDetail, failed []*itemDetail) error) {
+	if svc.Jobs == nil {
+		c.String(http.StatusServiceUnavailable, "Export jobs are not available")
+		return
+	}
+	pools := getPoolsFromContext(c)
+	if len(pools) == 0 {
+		log.Printf("ERROR: No pools found for export job")
+		c.String(http.StatusNotFound, "Unable to find item details")
+		return
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		log.Printf("ERROR: Unable to generate export job id: %s", err.Error())
+		c.String(http.StatusInternalServerError, "Unable to create export job")
+		return
+	}
+	job.ID = id
+	job.UserID = jobUserID(c)
+	job.Status = jobPending
+	job.Total = len(req.Items)
+	job.ExpiresAt = time.Now().Add(svc.Jobs.retention)
+	if resp := svc.GDB.Create(job); resp.Error != nil {
+		log.Printf("ERROR: Unable to save export job: %s", resp.Error.Error())
+		c.String(http.StatusInternalServerError, "Unable to create export job")
+		return
+	}
+
+	log.Printf("INFO: started %s export job %s for %d items", job.Format, job.ID, job.Total)
+	go svc.Jobs.run(job, pools, *jobClaims(c), req.Items, write)
+
+	c.Header("Location", fmt.Sprintf("/api/jobs/%s", job.ID))
+	c.JSON(http.StatusAccepted, job)
+}
+
+// run fetches the item details for a job, writes the artifact and saves it. Progress is
+// saved at most once a second while details are being fetched; the progress callback is
+// made from the goroutine collecting the responses so the counts need no locking. Jobs
+// outlive the request that submitted them, so they are not tied to its context or its JWT
+func (js *jobStore) run(job *exportJob, pools []*pool, claims v4jwt.V4Claims, items []requestItem,
+	write func(buf *bytes.Buffer, details []*itemDetail, failed []*itemDetail) error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("ERROR: export job %s panicked: %v\n%s", job.ID, r, debug.Stack())
+			js.fail(job.ID, fmt.Sprintf("unable to write %s export", job.Format))
+		}
+	}()
+	js.update(job.ID, map[string]interface{}{"status": jobRunning})
+
+	token, err := v4jwt.Mint(claims, js.tokenLifetime, js.svc.JWTKey)
+	if err != nil {
+		log.Printf("ERROR: unable to mint a token for export job %s: %s", job.ID, err.Error())
+		js.fail(job.ID, "unable to authorize export job")
+		return
+	}
+	authorization := fmt.Sprintf("Bearer %s", token)
+
+	fetched, failedCnt := 0, 0
+	lastSave := time.Now()
+	start := time.Now()
+	details, failed := js.svc.fetchItems(context.Background(), pools, authorization, items, func(item *itemDetail) {
+		if item.StatusCode == http.StatusOK {
+			fetched++
+		} else {
+			failedCnt++
+		}
+		if time.Since(lastSave) >= time.Second {
+			lastSave = time.Now()
+			js.update(job.ID, map[string]interface{}{"fetched": fetched, "failed": failedCnt})
+		}
+	})
+	elapsedMS := int64(time.Since(start) / time.Millisecond)
+	log.Printf("INFO: export job %s received item details in %dms; %d failed", job.ID, elapsedMS, len(failed))
+
+	now := time.Now()
+	done := map[string]interface{}{"fetched": len(details), "failed": len(failed), "completed_at": now,
+		"expires_at": now.Add(js.retention)}
+	var buf bytes.Buffer
+	if err = write(&buf, details, failed); err != nil {
+		log.Printf("ERROR: export job %s failed: %s", job.ID, err.Error())
+		done["status"] = jobFailed
+		done["message"] = fmt.Sprintf("unable to write %s export", job.Format)
+	} else {
+		done["status"] = jobComplete
+		done["result"] = buf.Bytes()
+	}
+	js.update(job.ID, done)
+}
+
+// fail marks a job as failed with a message for the user
+func (js *jobStore) fail(id string, message string) {
+	now := time.Now()
+	js.update(id, map[string]interface{}{"status": jobFailed, "message": message, "completed_at": now,
+		"expires_at": now.Add(js.retention)})
+}
+
+func (js *jobStore) update(id string, fields map[string]interface{}) {
+	resp := js.svc.GDB.Model(&exportJob{}).Where("id = ?", id).Updates(fields)
+	if resp.Error != nil {
+		log.Printf("ERROR: unable to update export job %s: %s", id, resp.Error.Error())
+	}
+}
+
+// findJob returns the unexpired job with the ID from the request path if it belongs to the
+// requesting user. A response has already been sent if it returns nil
+func (svc *ServiceContext) findJob(c *gin.Context, withResult bool) *exportJob {
+	if svc.Jobs == nil {
+		c.String(http.StatusServiceUnavailable, "Export jobs are not available")
+		return nil
+	}
+	var job exportJob
+	query := svc.GDB.Where("id = ? and user_id = ? and expires_at > ?", c.Param("id"), jobUserID(c), time.Now())
+	if withResult == false {
+		query = query.Omit("result")
+	}
+	resp := query.First(&job)
+	if resp.Error != nil {
+		if errors.Is(resp.Error, gorm.ErrRecordNotFound) {
+			c.String(http.StatusNotFound, "Export job not found")
+		} else {
+			log.Printf("ERROR: Unable to get export job %s: %s", c.Param("id"), resp.Error.Error())
+			c.String(http.StatusInternalServerError, "Unable to get export job")
+		}
+		return nil
+	}
+	return &job
+}
+
+// GetExportJob reports the status and progress of an export job
+func (svc *ServiceContext) GetExportJob(c *gin.Context) {
+	job := svc.findJob(c, false)
+	if job == nil {
+		return
+	}
+	if job.Status == jobComplete {
+		job.DownloadURL = fmt.Sprintf("/api/jobs/%s/download", job.ID)
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// DownloadExportJob returns the artifact of a completed export job
+func (svc *ServiceContext) DownloadExportJob(c *gin.Context) {
+	job := svc.findJob(c, true)
+	if job == nil {
+		return
+	}
+	if job.Status != jobComplete {
+		c.String(http.StatusConflict, fmt.Sprintf("Export job is %s", job.Status))
+		return
+	}
+	c.Header("X-Export-Requested", fmt.Sprintf("%d", job.Total))
+	c.Header("X-Export-Failed", fmt.Sprintf("%d", job.Failed))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", job.FileName))
+	c.Data(http.StatusOK, job.ContentType, job.Result)
+}
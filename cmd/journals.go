@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uvalib/virgo4-api/v4api"
+)
+
+// journal browse fields in the Solr core. The title key is the normalized title that
+// journals are browsed (and sorted) by; it must be normalized by the indexer the same
+// way normalizeJournalTitle does it
+const (
+	journalKeyField       = "journal_title_key"
+	journalTitleField     = "journal_title"
+	journalISSNField      = "issn_a"
+	journalPublisherField = "publisher_a"
+	journalHoldingsField  = "holdings_a"
+)
+
+const (
+	journalDefaultRows = 20
+	journalMaxRows     = 100
+)
+
+// journalBrowseResponse is a page of journals in title order. Each journal is a V4 record
+// with its title, ISSNs, publishers and holdings coverage summaries. Next is the cursor to
+// pass as the after param to get the following page
+type journalBrowseResponse struct {
+	Start      string           `json:"start,omitempty"`
+	After      string           `json:"after,omitempty"`
+	Pagination v4api.Pagination `json:"pagination"`
+	Journals   []v4api.Record   `json:"journal_list"`
+	Next       string           `json:"next,omitempty"`
+	ElapsedMS  int64            `json:"elapsed_ms"`
+}
+
+type solrBrowseResponse struct {
+	Response struct {
+		NumFound int                      `json:"numFound"`
+		Docs     []map[string]interface{} `json:"docs"`
+	} `json:"response"`
+}
+
+// journalCursor is the position after the last journal on a page. Title keys are not unique
+// (editions and publishers often share a title), so journals are ordered by title key and
+// then ID, and the cursor holds both
+type journalCursor struct {
+	key string
+	id  string
+}
+
+// String encodes the cursor as an opaque, URL safe value
+func (jc journalCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(jc.key + "\x00" + jc.id))
+}
+
+func parseJournalCursor(val string) (journalCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(val)
+	if err != nil {
+		return journalCursor{}, err
+	}
+	key, id, found := strings.Cut(string(raw), "\x00")
+	if found == false || id == "" {
+		return journalCursor{}, errors.New("malformed cursor")
+	}
+	return journalCursor{key: key, id: id}, nil
+}
+
+// BrowseJournals pages alphabetically through the journal titles in the journal browse Solr
+// core. The start param begins the list at a title prefix, after continues a list after the
+// cursor returned as next in the previous page, and rows sets the page size
+func (svc *ServiceContext) BrowseJournals(c *gin.Context) {
+	rows := journalDefaultRows
+	if rowsStr := c.Query("rows"); rowsStr != "" {
+		val, err := strconv.Atoi(rowsStr)
+		if err != nil || val < 1 || val > journalMaxRows {
+			c.String(http.StatusBadRequest, fmt.Sprintf("rows must be between 1 and %d", journalMaxRows))
+			return
+		}
+		rows = val
+	}
+
+	start := c.Query("start")
+	after := c.Query("after")
+	rangeQ := fmt.Sprintf("%s:[%s TO *]", journalKeyField, solrQuote(normalizeJournalTitle(start)))
+	if after != "" {
+		cursor, err := parseJournalCursor(after)
+		if err != nil {
+			c.String(http.StatusBadRequest, "after must be the next value from a previous page")
+			return
+		}
+		rangeQ = fmt.Sprintf("%s:{%s TO *] OR (%s:%s AND id:{%s TO *])", journalKeyField, solrQuote(cursor.key),
+			journalKeyField, solrQuote(cursor.key), solrQuote(cursor.id))
+	}
+
+	// one extra row is requested to know if there is a next page
+	qp := url.Values{}
+	qp.Set("q", "*:*")
+	qp.Set("fq", rangeQ)
+	qp.Set("sort", fmt.Sprintf("%s asc,id asc", journalKeyField))
+	qp.Set("rows", strconv.Itoa(rows+1))
+	qp.Set("fl", strings.Join([]string{"id", journalKeyField, journalTitleField, journalISSNField,
+		journalPublisherField, journalHoldingsField}, ","))
+	qp.Set("wt", "json")
+	sURL := fmt.Sprintf("%s/%s/select?%s", strings.TrimSuffix(svc.Solr.URL, "/"), svc.Solr.Core, qp.Encode())
+
+	log.Printf("INFO: browse journals from [%s] after [%s]", start, after)
+	resp := serviceRequest(c.Request.Context(), "GET", sURL, nil, nil, svc.HTTPClient)
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("ERROR: journal browse failed: %d %s", resp.StatusCode, resp.Response)
+		c.String(http.StatusInternalServerError, "Unable to browse journals")
+		return
+	}
+
+	var solrResp solrBrowseResponse
+	if err := json.Unmarshal(resp.Response, &solrResp); err != nil {
+		log.Printf("ERROR: malformed journal browse response: %s", err.Error())
+		c.String(http.StatusInternalServerError, "Unable to browse journals")
+		return
+	}
+
+	out := journalBrowseResponse{Start: start, After: after, ElapsedMS: resp.ElapsedMS,
+		Pagination: v4api.Pagination{Rows: rows, Total: solrResp.Response.NumFound},
+		Journals:   make([]v4api.Record, 0, rows)}
+	docs := solrResp.Response.Docs
+	if len(docs) > rows {
+		docs = docs[:rows]
+		last := docs[rows-1]
+		out.Next = journalCursor{key: firstSolrValue(last[journalKeyField]), id: firstSolrValue(last["id"])}.String()
+	}
+	for _, doc := range docs {
+		out.Journals = append(out.Journals, journalRecord(doc))
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// journalRecord converts a journal Solr document to a V4 record
+func journalRecord(doc map[string]interface{}) v4api.Record {
+	rec := v4api.Record{Fields: make([]v4api.RecordField, 0)}
+	rec.Fields = append(rec.Fields, v4api.RecordField{Name: "id", Type: "identifier", Label: "Identifier",
+		Value: firstSolrValue(doc["id"])})
+	rec.Fields = append(rec.Fields, v4api.RecordField{Name: "title", Type: "title", Label: "Title",
+		Value: firstSolrValue(doc[journalTitleField])})
+	for _, val := range solrValues(doc[journalISSNField]) {
+		rec.Fields = append(rec.Fields, v4api.RecordField{Name: "issn", Label: "ISSN", Value: val})
+	}
+	for _, val := range solrValues(doc[journalPublisherField]) {
+		rec.Fields = append(rec.Fields, v4api.RecordField{Name: "publisher", Label: "Publisher", Value: val})
+	}
+	for _, val := range solrValues(doc[journalHoldingsField]) {
+		rec.Fields = append(rec.Fields, v4api.RecordField{Name: "coverage", Label: "Coverage", Value: val})
+	}
+	return rec
+}
+
+// solrValues returns the values of a single or multi-valued Solr field as strings
+func solrValues(val interface{}) []string {
+	switch v := val.(type) {
+	case nil:
+		return []string{}
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			out = append(out, fmt.Sprintf("%v", item))
+		}
+		return out
+	default:
+		return []string{fmt.Sprintf("%v", v)}
+	}
+}
+
+// firstSolrValue returns the first value of a Solr field, or an empty string
+func firstSolrValue(val interface{}) string {
+	vals := solrValues(val)
+	if len(vals) == 0 {
+		return ""
+	}
+	return vals[0]
+}
+
+// normalizeJournalTitle converts a title to a browse key: lower case, punctuation removed,
+// whitespace collapsed and a leading article dropped
+func normalizeJournalTitle(title string) string {
+	mapped := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+		return -1
+	}, title)
+	words := strings.Fields(mapped)
+	if len(words) > 1 {
+		switch words[0] {
+		case "the", "a", "an":
+			words = words[1:]
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// solrQuote quotes a value for use as a Solr range endpoint
+func solrQuote(val string) string {
+	val = strings.ReplaceAll(val, "\\", "\\\\")
+	return fmt.Sprintf("\"%s\"", strings.ReplaceAll(val, "\"", "\\\""))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// solrQuoted matches a value quoted by solrQuote
+const solrQuoted = `"((?:[^"\\]|\\.)*)"`
+
+var (
+	startRange = regexp.MustCompile(`^journal_title_key:\[` + solrQuoted + ` TO \*\]$`)
+	afterRange = regexp.MustCompile(`^journal_title_key:\{` + solrQuoted + ` TO \*\] OR \(journal_title_key:` +
+		solrQuoted + ` AND id:\{` + solrQuoted + ` TO \*\]\)$`)
+)
+
+func solrUnquote(val string) string {
+	return regexp.MustCompile(`\\(.)`).ReplaceAllString(val, "$1")
+}
+
+// newJournalSolr returns a Solr stub that answers journal browse queries over the docs, which
+// must be in title key and ID order
+func newJournalSolr(t *testing.T, docs []map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		qp := r.URL.Query()
+		if qp.Get("sort") != "journal_title_key asc,id asc" {
+			t.Errorf("sort = %q", qp.Get("sort"))
+		}
+		include := func(key string, id string) bool { return false }
+		if m := startRange.FindStringSubmatch(qp.Get("fq")); m != nil {
+			include = func(key string, id string) bool { return key >= solrUnquote(m[1]) }
+		} else if m := afterRange.FindStringSubmatch(qp.Get("fq")); m != nil {
+			include = func(key string, id string) bool {
+				return key > solrUnquote(m[1]) || (key == solrUnquote(m[2]) && id > solrUnquote(m[3]))
+			}
+		} else {
+			t.Errorf("unexpected fq %q", qp.Get("fq"))
+		}
+		rows, _ := strconv.Atoi(qp.Get("rows"))
+
+		var resp solrBrowseResponse
+		resp.Response.Docs = make([]map[string]interface{}, 0)
+		for _, doc := range docs {
+			if include(doc[journalKeyField].(string), doc["id"].(string)) {
+				resp.Response.NumFound++
+				if len(resp.Response.Docs) < rows {
+					resp.Response.Docs = append(resp.Response.Docs, doc)
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+}
+
+func TestBrowseJournalsPaging(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	docs := make([]map[string]interface{}, 0)
+	wantIDs := []string{"n1", "s1", "s2", "s3", "s4", "s5", "z1"}
+	for _, id := range wantIDs {
+		key := map[byte]string{'n': "nature", 's': "science", 'z': "zoology"}[id[0]]
+		docs = append(docs, map[string]interface{}{"id": id, journalKeyField: key, journalTitleField: key})
+	}
+	solr := newJournalSolr(t, docs)
+	defer solr.Close()
+	svc := &ServiceContext{Solr: SolrConfig{URL: solr.URL, Core: "journals"}, HTTPClient: solr.Client()}
+
+	tests := []struct {
+		name     string
+		start    string
+		rows     int
+		wantIDs  []string
+		wantNext int
+	}{
+		{name: "page ends inside a group of equal keys", rows: 3, wantIDs: wantIDs, wantNext: 2},
+		{name: "page ends at the end of a group", rows: 6, wantIDs: wantIDs, wantNext: 1},
+		{name: "start at a title prefix", start: "Science", rows: 4, wantIDs: wantIDs[1:], wantNext: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qp := url.Values{}
+			qp.Set("rows", strconv.Itoa(tt.rows))
+			qp.Set("start", tt.start)
+			ids := make([]string, 0)
+			pages := 0
+			for {
+				w := httptest.NewRecorder()
+				c, _ := gin.CreateTestContext(w)
+				c.Request = httptest.NewRequest(http.MethodGet, "/api/journals/browse?"+qp.Encode(), nil)
+				svc.BrowseJournals(c)
+				if w.Code != http.StatusOK {
+					t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+				}
+				var page journalBrowseResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+					t.Fatalf("malformed response: %s", err.Error())
+				}
+				for _, rec := range page.Journals {
+					ids = append(ids, rec.Fields[0].Value)
+				}
+				if page.Next == "" {
+					break
+				}
+				pages++
+				if pages > len(docs) {
+					t.Fatalf("paging did not end")
+				}
+				qp.Set("after", page.Next)
+			}
+			if slices.Equal(ids, tt.wantIDs) == false {
+				t.Errorf("journals = %s, want %s", strings.Join(ids, ","), strings.Join(tt.wantIDs, ","))
+			}
+			if pages != tt.wantNext {
+				t.Errorf("%d pages had a next cursor, want %d", pages, tt.wantNext)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/journals/browse?after=science", nil)
+	svc.BrowseJournals(c)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status for a title key cursor = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -34,7 +34,8 @@ func main() {
 	corsCfg := cors.DefaultConfig()
 	corsCfg.AllowAllOrigins = true
 	corsCfg.AllowCredentials = true
-	corsCfg.AddAllowHeaders("Authorization")
+	corsCfg.AddAllowHeaders("Authorization", "If-None-Match", "If-Modified-Since")
+	corsCfg.AddExposeHeaders("Content-Disposition", "X-Export-Requested", "X-Export-Failed", "Location", "ETag")
 	router.Use(cors.New(corsCfg))
 	p := ginprometheus.NewPrometheus("gin")
 
@@ -57,10 +58,17 @@ func main() {
 		api.GET("/pools", svc.PoolsMiddleware, svc.GetPoolsRequest)
 		api.POST("/search", svc.AuthMiddleware, svc.PoolsMiddleware, svc.Search)
 		api.GET("/filters", svc.AuthMiddleware, svc.PoolsMiddleware, svc.GetSearchFilters)
+		api.POST("/filters", svc.AuthMiddleware, svc.PoolsMiddleware, svc.GetQueryFilters)
+		api.POST("/jobs/export", svc.AuthMiddleware, svc.PoolsMiddleware, svc.SubmitExportJob)
+		api.POST("/jobs/pdf", svc.AuthMiddleware, svc.PoolsMiddleware, svc.SubmitPDFJob)
+		api.GET("/jobs/:id", svc.AuthMiddleware, svc.GetExportJob)
+		api.GET("/jobs/:id/download", svc.AuthMiddleware, svc.DownloadExportJob)
+		api.GET("/journals/browse", svc.AuthMiddleware, svc.BrowseJournals)
 	}
 
 	if admin := router.Group("/admin", svc.AuthMiddleware, svc.AdminMiddleware); admin != nil {
 		pprof.RouteRegister(admin, "pprof")
+		admin.GET("/pools", svc.GetPoolRegistry)
 	}
 
 	portStr := fmt.Sprintf(":%d", cfg.Port)
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/signintech/gopdf"
+	"golang.org/x/text/unicode/bidi"
+)
+
+// GeneratePDF accepts a list of objects containg pool and identifer as POST data
+// It will generate a PDF containing details about the items that can be used to help find
+// the items in the stacks
+func (svc *ServiceContext) GeneratePDF(c *gin.Context) {
+	var req exportRequest
+	if err := c.BindJSON(&req); err != nil {
+		log.Printf("ERROR: Unable to parse PDF request: %s", err.Error())
+		c.String(http.StatusBadRequest, "Invalid PDF request")
+		return
+	}
+
+	baseURL, layout, err := svc.validatePDF(&req)
+	if err != nil {
+		log.Printf("ERROR: Invalid PDF request: %s", err.Error())
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	start := time.Now()
+	out, failed, err := svc.lookupItems(c, req.Items)
+	elapsed := time.Since(start)
+	elapsedMS := int64(elapsed / time.Millisecond)
+	if err != nil {
+		log.Printf("ERROR: Unable to get PDF item details: %s", err.Error())
+		c.String(http.StatusNotFound, "Unable to find item details")
+		return
+	}
+	log.Printf("SUCCESS: All item details for printout receieved in %dms; %d failed", elapsedMS, len(failed))
+
+	var buf bytes.Buffer
+	if err := svc.writePDF(&buf, &req, layout, baseURL, out, failed); err != nil {
+		log.Printf("ERROR: Unable to generate PDF: %s", err.Error())
+		c.String(http.StatusInternalServerError, "Unable to generate PDF")
+		return
+	}
+
+	setFailureHeaders(c, len(req.Items), failed)
+	c.Header("Content-Disposition", "attachment; filename=results.pdf")
+	c.Data(http.StatusOK, "application/pdf", buf.Bytes())
+}
+
+// validatePDF checks the base URL, sort, columns, layout and page settings of a PDF request.
+// It returns the base URL used for item links and the page layout
+func (svc *ServiceContext) validatePDF(req *exportRequest) (string, *pdfLayout, error) {
+	baseURL, err := svc.exportBaseURL(req)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if _, ok := itemSorts[req.Sort]; req.Sort != "" && !ok {
+		return "", nil, fmt.Errorf("Unsupported sort %s", req.Sort)
+	}
+
+	if _, err := exportColumns(req, nil); err != nil {
+		return "", nil, err
+	}
+
+	if req.Layout != "" && req.Layout != "list" && req.Layout != "pull_list" {
+		return "", nil, fmt.Errorf("Unsupported layout %s", req.Layout)
+	}
+
+	headerSpace := 0
+	if req.Layout == "pull_list" {
+		headerSpace = pullListHeaderSpace
+	}
+	layout, err := newPDFLayout(req, headerSpace)
+	if err != nil {
+		return "", nil, err
+	}
+	return baseURL, layout, nil
+}
+
+// writePDF renders the item details as a PDF and writes it to w
+func (svc *ServiceContext) writePDF(w io.Writer, req *exportRequest, layout *pdfLayout, baseURL string, out []*itemDetail, failed []*itemDetail) error {
+	pdf := gopdf.GoPdf{}
+	pdf.Start(gopdf.Config{PageSize: layout.Page})
+	if err := svc.Fonts.addTo(&pdf); err != nil {
+		return err
+	}
+	doc := &pdfDoc{pdf: &pdf, fonts: svc.Fonts, layout: layout}
+	if req.Layout == "pull_list" {
+		doc.addPullListHeaders(req.Title)
+	}
+	pdf.AddPage()
+
+	sortItems(out, req.Sort)
+
+	// title, author, location and call number are always printed. Any other requested
+	// fields are printed after them as label: value lines
+	extraCols := make([]exportColumn, 0)
+	if len(req.Fields) > 0 || req.Profile != "" {
+		cols, _ := exportColumns(req, out)
+		for _, col := range cols {
+			switch col.Name {
+			case "title", "author", "location", "call_number":
+				continue
+			}
+			extraCols = append(extraCols, col)
+		}
+	}
+
+	// render the PDF..
+	left := layout.Left()
+	yPos := layout.Top
+	if req.Title != "" {
+		yPos = doc.renderLine(left, yPos, req.Title, fontBold, 12)
+	}
+	if req.Notes != "" {
+		yPos += 5
+		yPos = doc.renderLine(left, yPos, req.Notes, fontRegular, 10)
+	}
+	if yPos > layout.Top {
+		yPos += 8
+		doc.rule(yPos)
+		yPos += 15
+	}
+
+	if req.Layout == "pull_list" {
+		yPos = doc.renderPullList(yPos, out, baseURL)
+	} else {
+		yPos = doc.renderItemList(yPos, out, extraCols, baseURL)
+	}
+
+	if len(failed) > 0 {
+		yPos = doc.keepTogether(yPos+5, 40)
+		doc.rule(yPos)
+		yPos += 15
+		yPos = doc.renderLine(left, yPos, "Could not retrieve", fontBold, 10)
+		for _, item := range failed {
+			yPos = doc.renderLine(left+pdfIndent, yPos, fmt.Sprintf("%s %s: %s", item.Pool, item.Identifier, item.Message), fontRegular, 10)
+		}
+	}
+
+	_, err := pdf.WriteTo(w)
+	return err
+}
+
+// pdfDoc is a PDF document along with the font chain used to render its text
+type pdfDoc struct {
+	pdf    *gopdf.GoPdf
+	fonts  *fontChain
+	layout *pdfLayout
+}
+
+// render the items as a flat list of title, author, location and call number along with
+// any extra requested columns. return the new Y position
+func (doc *pdfDoc) renderItemList(yPos int, items []*itemDetail, extraCols []exportColumn, baseURL string) int {
+	left := doc.layout.Left()
+	for _, item := range items {
+		lines := []string{strings.Join(item.Author, "; "), strings.Join(item.Location, "; "),
+			strings.Join(item.CallNumber, "; ")}
+		for _, col := range extraCols {
+			if val := col.Value(item, baseURL); val != "" {
+				lines = append(lines, fmt.Sprintf("%s: %s", col.Label, val))
+			}
+		}
+		title := strings.Join(item.Title, "; ")
+
+		// keep the whole item block on one page
+		blockH := doc.wrappedHeight(doc.lineWidth(left), title, fontBold, 10)
+		for _, l := range lines {
+			blockH += doc.wrappedHeight(doc.lineWidth(left+pdfIndent), l, fontRegular, 10)
+		}
+		yPos = doc.keepTogether(yPos, blockH)
+
+		yPos = doc.renderLine(left, yPos, title, fontBold, 10)
+		for _, l := range lines {
+			yPos = doc.renderLine(left+pdfIndent, yPos, l, fontRegular, 10)
+		}
+		yPos += 10
+	}
+	return yPos
+}
+
+// render a line of the PDF with line breaks, from xPos to the right margin. return the new Y position
+func (doc *pdfDoc) renderLine(xPos int, yPos int, line string, style string, fontSize int) int {
+	return doc.renderWrapped(xPos, yPos, doc.lineWidth(xPos), line, style, fontSize)
+}
+
+// lineWidth returns the width available for a line that starts at xPos
+func (doc *pdfDoc) lineWidth(xPos int) float64 {
+	return doc.layout.Right() - float64(xPos)
+}
+
+// render a line of the PDF with line breaks at the specified width. Right-to-left
+// lines are right aligned. return the new Y position
+func (doc *pdfDoc) renderWrapped(xPos int, yPos int, width float64, line string, style string, fontSize int) int {
+	rtl := isRTL(line)
+	lines := doc.wrapText(line, style, fontSize, width)
+	wrapH, lastH := lineHeights(fontSize)
+	for idx, l := range lines {
+		if yPos+wrapH > doc.layout.Bottom {
+			doc.pdf.AddPage()
+			yPos = doc.layout.Top
+		}
+		visual := visualOrder(l, rtl)
+		x := float64(xPos)
+		if rtl {
+			x += width - doc.measureText(visual, style, fontSize)
+		}
+		doc.drawText(x, float64(yPos), visual, style, fontSize)
+		if idx < len(lines)-1 {
+			yPos += wrapH
+		} else {
+			yPos += lastH
+		}
+	}
+	return yPos
+}
+
+// measureText returns the width of text rendered with the font chain
+func (doc *pdfDoc) measureText(text string, style string, fontSize int) float64 {
+	width := 0.0
+	for _, run := range doc.fonts.fontRuns(text, style) {
+		doc.pdf.SetFont(run.font, "", fontSize)
+		runW, _ := doc.pdf.MeasureTextWidth(run.text)
+		width += runW
+	}
+	return width
+}
+
+// drawText draws a single line of text at the position, switching fonts as needed
+func (doc *pdfDoc) drawText(x float64, y float64, text string, style string, fontSize int) {
+	for _, run := range doc.fonts.fontRuns(text, style) {
+		doc.pdf.SetFont(run.font, "", fontSize)
+		doc.pdf.SetXY(x, y)
+		doc.pdf.Cell(nil, run.text)
+		runW, _ := doc.pdf.MeasureTextWidth(run.text)
+		x += runW
+	}
+}
+
+// isRTL returns true if the first strongly directional character in the text is right-to-left
+func isRTL(text string) bool {
+	for _, r := range text {
+		props, _ := bidi.LookupRune(r)
+		switch props.Class() {
+		case bidi.R, bidi.AL:
+			return true
+		case bidi.L:
+			return false
+		}
+	}
+	return false
+}
+
+var mirroredRunes = map[rune]rune{'(': ')', ')': '(', '[': ']', ']': '[', '{': '}', '}': '{', '<': '>', '>': '<'}
+
+// visualOrder converts a line from logical to visual (left to right) order. Each character is
+// given an embedding level by bidiLevels; runs at odd (right-to-left) levels are reversed (and
+// Arabic is shaped), then the runs are reordered level by level as in rule L2 of the Unicode
+// bidirectional algorithm
+func visualOrder(line string, rtl bool) string {
+	type levelRun struct {
+		level int
+		runes []rune
+	}
+	runes := []rune(line)
+	paraLevel := 0
+	if rtl {
+		paraLevel = 1
+	}
+	levels := bidiLevels(runes, paraLevel)
+	if slices.ContainsFunc(levels, func(level int) bool { return level > 0 }) == false {
+		return line
+	}
+
+	runs := make([]*levelRun, 0)
+	for i, r := range runes {
+		if len(runs) == 0 || runs[len(runs)-1].level != levels[i] {
+			runs = append(runs, &levelRun{level: levels[i]})
+		}
+		runs[len(runs)-1].runes = append(runs[len(runs)-1].runes, r)
+	}
+
+	out := make([]string, 0, len(runs))
+	highest, lowestOdd := 0, math.MaxInt
+	for _, run := range runs {
+		highest = max(highest, run.level)
+		if run.level%2 == 0 {
+			out = append(out, string(run.runes))
+			continue
+		}
+		lowestOdd = min(lowestOdd, run.level)
+		if strings.ContainsFunc(string(run.runes), func(r rune) bool { return unicode.Is(unicode.Arabic, r) }) {
+			out = append(out, gopdf.ToArabic(string(mirrorRunes(run.runes))))
+			continue
+		}
+		out = append(out, string(reverseGraphemes(mirrorRunes(run.runes))))
+	}
+
+	// from the highest level down to the lowest odd level, reverse every sequence of runs
+	// at that level or higher
+	for level := highest; level >= lowestOdd; level-- {
+		for i := 0; i < len(runs); i++ {
+			if runs[i].level < level {
+				continue
+			}
+			end := i
+			for end < len(runs) && runs[end].level >= level {
+				end++
+			}
+			slices.Reverse(runs[i:end])
+			slices.Reverse(out[i:end])
+			i = end
+		}
+	}
+	return strings.Join(out, "")
+}
+
+// mirrorRunes swaps paired punctuation that must be mirrored in right-to-left text
+func mirrorRunes(runes []rune) []rune {
+	out := make([]rune, len(runes))
+	for i, r := range runes {
+		if m, ok := mirroredRunes[r]; ok {
+			r = m
+		}
+		out[i] = r
+	}
+	return out
+}
+
+// reverseGraphemes reverses runes while keeping combining marks after their base character
+func reverseGraphemes(runes []rune) []rune {
+	clusters := make([][]rune, 0)
+	for _, r := range runes {
+		if unicode.Is(unicode.Mn, r) && len(clusters) > 0 {
+			clusters[len(clusters)-1] = append(clusters[len(clusters)-1], r)
+			continue
+		}
+		clusters = append(clusters, []rune{r})
+	}
+	out := make([]rune, 0, len(runes))
+	for i := len(clusters) - 1; i >= 0; i-- {
+		out = append(out, clusters[i]...)
+	}
+	return out
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/signintech/gopdf"
+)
+
+func TestVisualOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		rtl  bool
+		want string
+	}{
+		{name: "left-to-right only", line: "Physics (2nd ed.) [1990]", want: "Physics (2nd ed.) [1990]"},
+		{name: "right-to-left only", line: "שלום עולם", rtl: true, want: "םלוע םולש"},
+		{name: "latin in parentheses", line: "שלום (abc) עולם", rtl: true, want: "םלוע (abc) םולש"},
+		{name: "edition in parentheses", line: "ספר (2nd ed.)", rtl: true, want: "(.2nd ed) רפס"},
+		{name: "trailing latin words", line: "שלום abc def", rtl: true, want: "abc def םולש"},
+		{name: "number with separator", line: "מהדורה 1,234", rtl: true, want: "1,234 הרודהמ"},
+		{name: "hebrew in parentheses", line: "Title (שלום)", want: "Title (םולש)"},
+		{name: "number after hebrew", line: "Vol. 3: שלום עולם 1990", want: "Vol. 3: 1990 םלוע םולש"},
+		{name: "arabic with arabic digits", line: "كتاب ١٢", rtl: true, want: "١٢" + gopdf.ToArabic("كتاب ")},
+		{name: "combining marks", line: "\u05E9\u05B8\u05C1\u05DC\u05D5\u05B9\u05DD abc", rtl: true,
+			want: "abc \u05DD\u05D5\u05B9\u05DC\u05E9\u05B8\u05C1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := visualOrder(tt.line, tt.rtl); got != tt.want {
+				t.Errorf("visualOrder(%q, %v) = %q, want %q", tt.line, tt.rtl, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/signintech/gopdf"
+)
+
+const (
+	pdfDefaultMargin = 20
+	pdfMinMargin     = 10
+	pdfMaxMargin     = 72
+	pdfIndent        = 10
+)
+
+// pdfPageSizes are the supported PDF page sizes, keyed by the page_size request param
+var pdfPageSizes = map[string]*gopdf.Rect{
+	"a4":     gopdf.PageSizeA4,
+	"letter": gopdf.PageSizeLetter,
+}
+
+// pdfLayout is the page geometry of a PDF. Top and Bottom are the Y positions that
+// bound the content area; any running header or footer is drawn outside of them
+type pdfLayout struct {
+	Page   gopdf.Rect
+	Margin int
+	Top    int
+	Bottom int
+}
+
+// newPDFLayout validates the requested page size and margin and returns the page layout.
+// headerSpace is reserved at the top and bottom of each page for running headers and footers
+func newPDFLayout(req *exportRequest, headerSpace int) (*pdfLayout, error) {
+	pageSize := strings.ToLower(req.PageSize)
+	if pageSize == "" {
+		pageSize = "a4"
+	}
+	page, ok := pdfPageSizes[pageSize]
+	if !ok {
+		return nil, fmt.Errorf("unsupported page size %s", req.PageSize)
+	}
+	margin := pdfDefaultMargin
+	if req.Margin != nil {
+		margin = *req.Margin
+	}
+	if margin < pdfMinMargin || margin > pdfMaxMargin {
+		return nil, fmt.Errorf("margin must be between %d and %d", pdfMinMargin, pdfMaxMargin)
+	}
+	out := pdfLayout{Page: *page, Margin: margin}
+	out.Top = margin + headerSpace
+	out.Bottom = int(page.H) - margin - headerSpace
+	return &out, nil
+}
+
+// Left returns the X position of the left edge of the content area
+func (l *pdfLayout) Left() int {
+	return l.Margin
+}
+
+// Right returns the X position of the right edge of the content area
+func (l *pdfLayout) Right() float64 {
+	return l.Page.W - float64(l.Margin)
+}
+
+// Width returns the width of the content area
+func (l *pdfLayout) Width() float64 {
+	return l.Right() - float64(l.Left())
+}
+
+// lineHeights returns the vertical space used by a wrapped line and by the last line of a paragraph
+func lineHeights(fontSize int) (int, int) {
+	return fontSize + 6, fontSize + 4
+}
+
+// keepTogether starts a new page if a block of the specified height will not fit below
+// yPos. Blocks taller than a full page are left to break across pages. return the new Y position
+func (doc *pdfDoc) keepTogether(yPos int, height int) int {
+	if yPos+height > doc.layout.Bottom && yPos > doc.layout.Top && height <= doc.layout.Bottom-doc.layout.Top {
+		doc.pdf.AddPage()
+		return doc.layout.Top
+	}
+	return yPos
+}
+
+// rule draws a horizontal line across the content area
+func (doc *pdfDoc) rule(yPos int) {
+	doc.pdf.Line(float64(doc.layout.Left()), float64(yPos), doc.layout.Right(), float64(yPos))
+}
+
+// wrappedHeight returns the height a line will use when rendered with renderWrapped
+func (doc *pdfDoc) wrappedHeight(width float64, line string, style string, fontSize int) int {
+	lines := len(doc.wrapText(line, style, fontSize, width))
+	if lines == 0 {
+		return 0
+	}
+	wrapH, lastH := lineHeights(fontSize)
+	return (lines-1)*wrapH + lastH
+}
+
+// wrapText splits a line into lines that fit in the width. Lines are broken on whitespace;
+// words that are too long for a line by themselves are broken with breakWord
+func (doc *pdfDoc) wrapText(line string, style string, fontSize int, width float64) []string {
+	out := make([]string, 0)
+	words := strings.Fields(line)
+	line = ""
+	for _, word := range words {
+		testLine := line
+		if testLine != "" {
+			testLine += " "
+		}
+		testLine += word
+		if doc.measureText(testLine, style, fontSize) <= width {
+			line = testLine
+			continue
+		}
+		if line != "" {
+			out = append(out, line)
+		}
+		line = word
+		for doc.measureText(line, style, fontSize) > width {
+			head, tail := doc.breakWord(line, style, fontSize, width)
+			out = append(out, head)
+			line = tail
+		}
+	}
+	if line != "" {
+		out = append(out, line)
+	}
+	return out
+}
+
+// breakAfter are characters that a long word (typically a URL or identifier) can be broken after without a hyphen
+const breakAfter = "/-.?&=_,;:"
+
+// breakWord splits a word that is wider than width into a head that fits and the remaining tail.
+// The break is made after punctuation in the latter half of the head if possible. Otherwise it is
+// made at the last character that fits, hyphenated if it falls between two letters
+func (doc *pdfDoc) breakWord(word string, style string, fontSize int, width float64) (string, string) {
+	runes := []rune(word)
+	hyphenW := doc.measureText("-", style, fontSize)
+
+	// find the most characters that fit, leaving room for a hyphen
+	fit := 0
+	for fit < len(runes) && doc.measureText(string(runes[:fit+1]), style, fontSize)+hyphenW <= width {
+		fit++
+	}
+	if fit == 0 {
+		// not even one character fits; make progress anyway
+		fit = 1
+	}
+	// never leave a combining mark at the start of the tail
+	for fit > 1 && fit < len(runes) && unicode.Is(unicode.Mn, runes[fit]) {
+		fit--
+	}
+
+	for i := fit; i > fit/2 && i > 0; i-- {
+		if strings.ContainsRune(breakAfter, runes[i-1]) {
+			return string(runes[:i]), string(runes[i:])
+		}
+	}
+	if fit < len(runes) && fit > 1 && unicode.IsLetter(runes[fit-1]) && unicode.IsLetter(runes[fit]) {
+		return string(runes[:fit]) + "-", string(runes[fit:])
+	}
+	return string(runes[:fit]), string(runes[fit:])
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -55,51 +56,21 @@ func getPoolsFromContext(c *gin.Context) []*pool {
 
 // GetPoolsRequest gets a list of all active pools and returns it as JSON
 func (svc *ServiceContext) GetPoolsRequest(c *gin.Context) {
-	pools := getPoolsFromContext(c)
-	out := make([]*poolResponse, 0)
-	channel := make(chan *poolResponse)
-	outstandingRequests := 0
-	for _, p := range pools {
-		outstandingRequests++
-		go poolProviders(&p.V4ID, channel, svc.FastHTTPClient)
+	out, version, modified, nextRefresh := svc.Pools.getPoolResponses()
+	if out == nil {
+		out = make([]*poolResponse, 0)
 	}
-
-	for outstandingRequests > 0 {
-		poolResp := <-channel
-		out = append(out, poolResp)
-		outstandingRequests--
+	if notModified(c, version, modified, nextRefresh) {
+		return
 	}
-
 	c.JSON(http.StatusOK, out)
 }
 
-// LookupPools fetches a list of current pools from the V4DB & pool /identify
-// Any pools that fail the /identify call will not be included
+// LookupPools returns the current list of identified pools from the pool registry.
+// Any pools that have never successfully identified will not be included
 func (svc *ServiceContext) lookupPools() ([]*pool, error) {
-	var sources []*source
 	log.Printf("INFO: lookup all pools")
-	dbResp := svc.GDB.Debug().Where("sequence > ? and enabled=?", 0, true).Order("sequence asc").Find(&sources)
-	if dbResp.Error != nil {
-		log.Printf("ERROR: Unable to get authoritative pool information: %s", dbResp.Error.Error())
-		return nil, dbResp.Error
-	}
-
-	channel := make(chan *identifyResult)
-	outstandingRequests := 0
-	for _, src := range sources {
-		outstandingRequests++
-		go identifyPool(src, channel, svc.FastHTTPClient)
-	}
-
-	pools := make([]*pool, 0)
-	for outstandingRequests > 0 {
-		idResp := <-channel
-		if idResp.Error == nil {
-			pools = append(pools, idResp.Pool)
-		}
-		outstandingRequests--
-	}
-
+	pools := svc.Pools.getPools()
 	if len(pools) == 0 {
 		log.Printf("ERROR: No pools found")
 		return nil, errors.New("no pools found")
@@ -109,42 +80,39 @@ func (svc *ServiceContext) lookupPools() ([]*pool, error) {
 }
 
 type identifyResult struct {
-	Pool  *pool
-	Error error
+	Source *source
+	Pool   *pool
+	Error  error
 }
 
-// Goroutine to do a pool identify and return the results over a channel
-func identifyPool(dbSrc *source, channel chan *identifyResult, httpClient *http.Client) {
+// identifyPool does a pool identify and returns the results
+func identifyPool(ctx context.Context, dbSrc *source, httpClient *http.Client) *identifyResult {
 	URL := fmt.Sprintf("%s/identify", dbSrc.PrivateURL)
 	start := time.Now()
 	identity := pool{PrivateURL: dbSrc.PrivateURL, Sequence: dbSrc.Sequence}
 
 	log.Printf("INFO: request %s identity information from %s", dbSrc.Name, URL)
-	idRequest, reqErr := http.NewRequest("GET", URL, nil)
+	idRequest, reqErr := http.NewRequestWithContext(ctx, "GET", URL, nil)
 	if reqErr != nil {
 		log.Printf("ERROR: Unable to generate identify request for %s", URL)
-		channel <- &identifyResult{Pool: nil, Error: fmt.Errorf("Unable to identify %s:%s", dbSrc.Name, dbSrc.PrivateURL)}
-		return
+		return &identifyResult{Source: dbSrc, Pool: nil, Error: fmt.Errorf("Unable to identify %s:%s", dbSrc.Name, dbSrc.PrivateURL)}
 	}
 	resp, err := httpClient.Do(idRequest)
 	if err != nil {
 		log.Printf("ERROR: %s /identify failed: %s", dbSrc.PrivateURL, err.Error())
-		channel <- &identifyResult{Pool: nil, Error: fmt.Errorf("Unable to identify %s:%s", dbSrc.Name, dbSrc.PrivateURL)}
-		return
+		return &identifyResult{Source: dbSrc, Pool: nil, Error: fmt.Errorf("Unable to identify %s:%s", dbSrc.Name, dbSrc.PrivateURL)}
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		log.Printf("ERROR: %s/identify returned bad status code : %d: ", dbSrc.PrivateURL, resp.StatusCode)
-		channel <- &identifyResult{Pool: nil, Error: fmt.Errorf("Unable to identify %s:%s", dbSrc.Name, dbSrc.PrivateURL)}
-		return
+		return &identifyResult{Source: dbSrc, Pool: nil, Error: fmt.Errorf("Unable to identify %s:%s", dbSrc.Name, dbSrc.PrivateURL)}
 	}
 
 	respTxt, _ := io.ReadAll(resp.Body)
 	err = json.Unmarshal(respTxt, &identity.V4ID)
 	if err != nil {
 		log.Printf("ERROR: Unable to parse response from %s: %s", dbSrc.PrivateURL, err.Error())
-		channel <- &identifyResult{Pool: nil, Error: fmt.Errorf("Unable to identify %s:%s", dbSrc.Name, dbSrc.PrivateURL)}
-		return
+		return &identifyResult{Source: dbSrc, Pool: nil, Error: fmt.Errorf("Unable to identify %s:%s", dbSrc.Name, dbSrc.PrivateURL)}
 	}
 
 	identity.V4ID.ID = dbSrc.Name
@@ -153,45 +121,43 @@ func identifyPool(dbSrc *source, channel chan *identifyResult, httpClient *http.
 	for _, attr := range identity.V4ID.Attributes {
 		if attr.Name == "external_hold" && attr.Supported == true {
 			identity.IsExternal = true
-			break
+		}
+		if attr.Name == "resource_batch" && attr.Supported == true {
+			identity.BatchSize = batchSize(attr.Value)
 		}
 	}
 	poolsNS := time.Since(start)
 	log.Printf("%s identified as %s. Time: %d ms", dbSrc.Name, identity.V4ID.Name, int64(poolsNS/time.Millisecond))
-	channel <- &identifyResult{Pool: &identity, Error: nil}
+	return &identifyResult{Source: dbSrc, Pool: &identity, Error: nil}
 }
 
-// Goroutine to get pool providers, append them to pool data and return result
-func poolProviders(pool *v4api.PoolIdentity, channel chan *poolResponse, httpClient *http.Client) {
+// poolProviders gets pool providers, appends them to pool data and returns the result
+func poolProviders(ctx context.Context, pool *v4api.PoolIdentity, httpClient *http.Client) *poolResponse {
 	log.Printf("Get pool providers for %s", pool.ID)
 	poolRes := poolResponse{PoolIdentity: pool}
 	URL := fmt.Sprintf("%s/api/providers", pool.URL)
-	provReq, reqErr := http.NewRequest("GET", URL, nil)
+	provReq, reqErr := http.NewRequestWithContext(ctx, "GET", URL, nil)
 	if reqErr != nil {
 		log.Printf("ERROR: Unable to generate identify request for %s", URL)
-		channel <- &poolRes
-		return
+		return &poolRes
 	}
 	resp, err := httpClient.Do(provReq)
 	if err != nil {
 		log.Printf("ERROR: %s failed: %s", URL, err.Error())
-		channel <- &poolRes
-		return
+		return &poolRes
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		log.Printf("ERROR: %s returned bad status code : %d: ", URL, resp.StatusCode)
-		channel <- &poolRes
-		return
+		return &poolRes
 	}
 	respTxt, _ := ioutil.ReadAll(resp.Body)
 	var prov v4api.PoolProviders
 	err = json.Unmarshal(respTxt, &prov)
 	if err != nil {
 		log.Printf("ERROR: %s returned invalid data: %s: ", URL, err.Error())
-		channel <- &poolRes
-		return
+		return &poolRes
 	}
 	poolRes.Providers = &prov.Providers
-	channel <- &poolRes
+	return &poolRes
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/signintech/gopdf"
+	"rsc.io/qr"
+)
+
+const (
+	pullListHeaderSpace = 20
+	pullListQRSize      = 54
+)
+
+// pullListGroup returns the library / location heading an item is grouped under
+func pullListGroup(item *itemDetail) string {
+	library := firstValue(item.Library)
+	if library == "" {
+		library = "Unknown library"
+	}
+	if location := firstValue(item.Location); location != "" {
+		return fmt.Sprintf("%s - %s", library, location)
+	}
+	return library
+}
+
+// addPullListHeaders adds a running header and page number footer to every page of the pull list.
+// Must be called before the first page is added.
+func (doc *pdfDoc) addPullListHeaders(title string) {
+	if title == "" {
+		title = "Pull List"
+	}
+	printed := time.Now().Format("2006-01-02 15:04")
+	title = visualOrder(title, isRTL(title))
+	pdf := doc.pdf
+	layout := doc.layout
+	left := float64(layout.Left())
+	headerY := float64(layout.Top - pullListHeaderSpace - 8)
+	pdf.AddHeader(func() {
+		doc.drawText(left, headerY, title, fontRegular, 8)
+		dateW := doc.measureText(printed, fontRegular, 8)
+		doc.drawText(layout.Right()-dateW, headerY, printed, fontRegular, 8)
+		pdf.Line(left, headerY+12, layout.Right(), headerY+12)
+	})
+	pdf.AddFooter(func() {
+		page := fmt.Sprintf("Page %d", pdf.GetNumberOfPages())
+		pageW := doc.measureText(page, fontRegular, 8)
+		doc.drawText((layout.Page.W-pageW)/2, float64(layout.Bottom+pullListHeaderSpace), page, fontRegular, 8)
+	})
+}
+
+// renderPullList renders the items grouped by library and location and sorted by call number
+// within each group. Each item includes a QR code that links to the item details page.
+// return the new Y position
+func (doc *pdfDoc) renderPullList(yPos int, items []*itemDetail, baseURL string) int {
+	pdf := doc.pdf
+	sortItems(items, "location")
+	left := doc.layout.Left()
+	textW := doc.lineWidth(left+pdfIndent) - pullListQRSize - 10
+	qrX := doc.layout.Right() - pullListQRSize
+
+	group := ""
+	for _, item := range items {
+		title := strings.Join(item.Title, "; ")
+		author := strings.Join(item.Author, "; ")
+		callNumber := strings.Join(item.CallNumber, "; ")
+
+		// keep the whole item block, and its group heading, on one page
+		blockH := doc.wrappedHeight(textW, title, fontBold, 10) + doc.wrappedHeight(textW, author, fontRegular, 10) +
+			doc.wrappedHeight(textW, callNumber, fontBold, 11)
+		if blockH < pullListQRSize {
+			blockH = pullListQRSize
+		}
+		itemGroup := pullListGroup(item)
+		if itemGroup != group {
+			blockH += 30
+		}
+		yPos = doc.keepTogether(yPos, blockH)
+
+		if itemGroup != group {
+			group = itemGroup
+			yPos = doc.renderLine(left, yPos, group, fontBold, 12)
+			doc.rule(yPos + 2)
+			yPos += 12
+		}
+
+		blockTop := yPos
+		yPos = doc.renderWrapped(left+pdfIndent, yPos, textW, callNumber, fontBold, 11)
+		yPos = doc.renderWrapped(left+pdfIndent, yPos, textW, title, fontBold, 10)
+		yPos = doc.renderWrapped(left+pdfIndent, yPos, textW, author, fontRegular, 10)
+
+		url := itemURL(baseURL, item)
+		code, err := qr.Encode(url, qr.M)
+		if err != nil {
+			log.Printf("WARNING: Unable to generate QR code for %s: %s", url, err.Error())
+		} else {
+			rect := gopdf.Rect{W: pullListQRSize, H: pullListQRSize}
+			if err := pdf.ImageFrom(code.Image(), qrX, float64(blockTop), &rect); err != nil {
+				log.Printf("WARNING: Unable to render QR code for %s: %s", url, err.Error())
+			} else {
+				pdf.AddExternalLink(url, qrX, float64(blockTop), pullListQRSize, pullListQRSize)
+			}
+		}
+
+		if yPos < blockTop+pullListQRSize {
+			yPos = blockTop + pullListQRSize
+		}
+		yPos += 10
+	}
+	return yPos
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uvalib/virgo4-api/v4api"
+)
+
+// GetQueryFilters returns the advanced search filters with values and counts for the results
+// of a search request. Facets are requested from every searched pool of a filter source, with
+// the same filter group the pool would be searched with. The counts from the pools of each
+// source are summed and the sources merged the same way as the cached filters. Pools that
+// fail or do not respond within the search deadline are left out
+func (svc *ServiceContext) GetQueryFilters(c *gin.Context) {
+	var req clientSearchRequest
+	if bindSearchRequest(c, &req) == false {
+		return
+	}
+
+	// counts are for the query the pools are searched with
+	if req.NoRewrite == false {
+		rewrite, _ := svc.Rewriter.rewrite(req.Query)
+		req.Query = rewrite.Rewritten
+	}
+
+	pools := getPoolsFromContext(c)
+	snapshot := svc.FilterCache.getSnapshot()
+	if status, err := checkGlobalFilters(&req, snapshot); err != nil {
+		log.Printf("INFO: Query [%s] has global filters that can't be applied: %s", req.Query, err.Details)
+		c.JSON(status, err)
+		return
+	}
+	sources := snapshot.sources
+	filterPools, filterPoolSources := searchedFilterPools(sources, pools)
+
+	headers := map[string]string{
+		"Content-Type":  "application/json",
+		"Authorization": c.GetHeader("Authorization"),
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), svc.SearchTimeout)
+	defer cancel()
+	start := time.Now()
+	poolResps := make([]*filterResponse, len(filterPools))
+	fanOut(ctx, "query_filters", len(filterPools), func(ctx context.Context, idx int) *filterResponse {
+		return svc.getPoolQueryFilters(ctx, filterPools[idx], filterPoolSources[idx], snapshot, &req, headers)
+	}, func(idx int, err error) *filterResponse {
+		return &filterResponse{pool: filterPools[idx]}
+	}, func(idx int, filterResp *filterResponse) {
+		poolResps[idx] = filterResp
+	})
+
+	if c.Request.Context().Err() != nil {
+		log.Printf("INFO: filters for [%s] abandoned by client after %d ms", req.Query, int64(time.Since(start)/time.Millisecond))
+		c.Abort()
+		return
+	}
+
+	sourceFilters, received := sumPoolFilters(poolResps)
+	log.Printf("Received query filters from %d of %d pools in %d ms", received, len(filterPools),
+		int64(time.Since(start)/time.Millisecond))
+	combined, _ := mergeFilters(sources, sourceFilters, snapshot.normalizer)
+	c.JSON(http.StatusOK, combined)
+}
+
+// searchedFilterPools returns every pool of each filter source, in order of source preference,
+// along with the matching filter source for each
+func searchedFilterPools(sources []*filterSource, pools []*pool) ([]*pool, []*filterSource) {
+	filterPools := make([]*pool, 0)
+	filterPoolSources := make([]*filterSource, 0)
+	for _, source := range sources {
+		for _, pool := range pools {
+			if pool.V4ID.Source == source.Source {
+				filterPools = append(filterPools, pool)
+				filterPoolSources = append(filterPoolSources, source)
+			}
+		}
+	}
+	return filterPools, filterPoolSources
+}
+
+// sumPoolFilters combines the facets from the pools of each source into a single response
+// for the source. Counts for the same facet value are summed; the other facet attributes come
+// from the first pool to provide the facet, except that a facet is hidden if any pool hides
+// it. Responses are combined in pool order. The number of pools that responded is also returned
+func sumPoolFilters(poolResps []*filterResponse) (map[string]*filterResponse, int) {
+	sourceFilters := make(map[string]*filterResponse)
+	// source -> facet ID -> index of the facet, and source -> facet ID -> value -> index of the bucket
+	facetIdx := make(map[string]map[string]int)
+	bucketIdx := make(map[string]map[string]map[string]int)
+	received := 0
+	for _, poolResp := range poolResps {
+		if poolResp == nil || poolResp.filters == nil {
+			continue
+		}
+		received++
+		source := poolResp.pool.V4ID.Source
+		sourceResp := sourceFilters[source]
+		if sourceResp == nil {
+			sourceResp = &filterResponse{pool: poolResp.pool, filters: &v4api.PoolFacets{}}
+			sourceFilters[source] = sourceResp
+			facetIdx[source] = make(map[string]int)
+			bucketIdx[source] = make(map[string]map[string]int)
+		}
+		if poolResp.updated.After(sourceResp.updated) {
+			sourceResp.updated = poolResp.updated
+		}
+
+		for _, facet := range poolResp.filters.FacetList {
+			idx, ok := facetIdx[source][facet.ID]
+			if ok == false {
+				idx = len(sourceResp.filters.FacetList)
+				facetIdx[source][facet.ID] = idx
+				bucketIdx[source][facet.ID] = make(map[string]int)
+				sourceResp.filters.FacetList = append(sourceResp.filters.FacetList,
+					v4api.Facet{ID: facet.ID, Name: facet.Name, Type: facet.Type, Sort: facet.Sort})
+			}
+			summed := &sourceResp.filters.FacetList[idx]
+			summed.Hidden = summed.Hidden || facet.Hidden
+			buckets := bucketIdx[source][facet.ID]
+			for _, bucket := range facet.Buckets {
+				bIdx, ok := buckets[bucket.Value]
+				if ok == false {
+					bIdx = len(summed.Buckets)
+					buckets[bucket.Value] = bIdx
+					summed.Buckets = append(summed.Buckets, v4api.FacetBucket{Value: bucket.Value})
+				}
+				summed.Buckets[bIdx].Count += bucket.Count
+			}
+		}
+	}
+	return sourceFilters, received
+}
+
+// getPoolQueryFilters requests the facets for a search from a pool and returns them prepared
+// for the filter source
+func (svc *ServiceContext) getPoolQueryFilters(ctx context.Context, pool *pool, source *filterSource,
+	snapshot *filterSnapshot, req *clientSearchRequest, headers map[string]string) *filterResponse {
+	resp := &filterResponse{pool: pool}
+	if unsupported := unsupportedFilters(req, pool, snapshot); len(unsupported) > 0 {
+		log.Printf("INFO: %s does not support filters %v; skipping query filters", pool.V4ID.ID, unsupported)
+		return resp
+	}
+	if svc.Breakers.allow(pool.V4ID.ID) == false {
+		log.Printf("WARNING: circuit breaker for %s is open; skipping query filters", pool.V4ID.ID)
+		return resp
+	}
+
+	poolReq := v4api.SearchRequest{Query: req.Query, Filters: poolFilters(req, pool, snapshot), Preferences: req.Preferences}
+	reqBytes, _ := json.Marshal(poolReq)
+	sURL := fmt.Sprintf("%s/api/search/facets", pool.PrivateURL)
+	postResp := serviceRequest(ctx, "POST", sURL, reqBytes, headers, svc.HTTPClient)
+	svc.Breakers.recordRequest(ctx, pool.V4ID.ID, postResp.StatusCode)
+	if postResp.StatusCode != http.StatusOK {
+		return resp
+	}
+
+	var filters v4api.PoolFacets
+	if err := json.Unmarshal(postResp.Response, &filters); err != nil {
+		log.Printf("ERROR: %s returned malformed facets: %s", pool.V4ID.ID, err.Error())
+		return resp
+	}
+	source.prepareFilters(&filters)
+
+	resp.filters = &filters
+	resp.updated = time.Now()
+	return resp
+}
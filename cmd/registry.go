@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uvalib/virgo4-api/v4api"
+)
+
+// registryEntry is the last known good identity of a single pool source
+type registryEntry struct {
+	pool      *pool
+	providers *[]v4api.Provider
+	refreshed time.Time
+	checked   time.Time
+	lastError string
+}
+
+// poolRegistry holds the identified pools in memory and refreshes them on
+// a background schedule so requests do not need to re-identify every pool
+type poolRegistry struct {
+	svc             *ServiceContext
+	refreshInterval int
+	lock            sync.RWMutex
+	entries         map[string]*registryEntry
+	lastRefresh     time.Time
+	response        []*poolResponse
+	version         string
+	modified        time.Time
+	nextRefresh     time.Time
+}
+
+// poolStatus is the JSON representation of a single registry entry
+type poolStatus struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Sequence  int       `json:"sequence"`
+	Refreshed time.Time `json:"refreshed"`
+	Checked   time.Time `json:"checked"`
+	Stale     bool      `json:"stale"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+func newPoolRegistry(svc *ServiceContext, interval int) *poolRegistry {
+	reg := poolRegistry{
+		svc:             svc,
+		refreshInterval: interval,
+		entries:         make(map[string]*registryEntry),
+	}
+
+	// populate the registry before any requests are handled
+	reg.refreshPools()
+
+	go reg.monitorPools()
+
+	return &reg
+}
+
+func (r *poolRegistry) monitorPools() {
+	for {
+		log.Printf("[POOLS] refresh scheduled in %d seconds", r.refreshInterval)
+		time.Sleep(time.Duration(r.refreshInterval) * time.Second)
+		r.refreshPools()
+	}
+}
+
+// refreshPools re-reads the sources table and identifies each enabled pool. Pools
+// that fail to identify keep their last known good identity. Pools that are no longer
+// enabled are removed from the registry.
+func (r *poolRegistry) refreshPools() {
+	log.Printf("[POOLS] refreshing pools...")
+	var sources []*source
+	dbResp := r.svc.GDB.Where("sequence > ? and enabled=?", 0, true).Order("sequence asc").Find(&sources)
+	if dbResp.Error != nil {
+		log.Printf("[POOLS] ERROR: Unable to get authoritative pool information: %s", dbResp.Error.Error())
+		return
+	}
+
+	// background refreshes are not tied to any client request
+	results := make([]*identifyResult, 0)
+	fanOut(context.Background(), "identify", len(sources), func(ctx context.Context, idx int) *identifyResult {
+		return identifyPool(ctx, sources[idx], r.svc.FastHTTPClient)
+	}, func(idx int, err error) *identifyResult {
+		return &identifyResult{Source: sources[idx], Error: fmt.Errorf("Unable to identify %s: %s", sources[idx].Name, err.Error())}
+	}, func(idx int, idResp *identifyResult) {
+		results = append(results, idResp)
+	})
+
+	// refreshPools is the only writer of the entries, so they can be read here without locking
+	now := time.Now()
+	entries := make(map[string]*registryEntry)
+	for _, idResp := range results {
+		name := idResp.Source.Name
+		if idResp.Error == nil {
+			entries[name] = &registryEntry{pool: idResp.Pool, refreshed: now, checked: now}
+			continue
+		}
+
+		prior := r.entries[name]
+		if prior == nil {
+			log.Printf("[POOLS] WARNING: %s failed to identify and has no prior identity", name)
+			entries[name] = &registryEntry{checked: now, lastError: idResp.Error.Error()}
+			continue
+		}
+
+		log.Printf("[POOLS] WARNING: %s failed to identify; keeping identity from %s", name, prior.refreshed.Format(time.RFC3339))
+		entries[name] = &registryEntry{pool: prior.pool, refreshed: prior.refreshed, checked: now, lastError: idResp.Error.Error()}
+	}
+
+	// get the providers for every identified pool. Pools that fail to respond keep their prior providers
+	names := make([]string, 0)
+	for name, e := range entries {
+		if e.pool != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return entries[names[i]].pool.Sequence < entries[names[j]].pool.Sequence
+	})
+	fanOut(context.Background(), "providers", len(names), func(ctx context.Context, idx int) *poolResponse {
+		return poolProviders(ctx, &entries[names[idx]].pool.V4ID, r.svc.FastHTTPClient)
+	}, func(idx int, err error) *poolResponse {
+		return &poolResponse{PoolIdentity: &entries[names[idx]].pool.V4ID}
+	}, func(idx int, poolResp *poolResponse) {
+		e := entries[names[idx]]
+		e.providers = poolResp.Providers
+		if prior := r.entries[names[idx]]; e.providers == nil && prior != nil {
+			e.providers = prior.providers
+		}
+	})
+
+	// build the /api/pools response once per refresh; the version only changes with the response
+	response := make([]*poolResponse, 0, len(names))
+	for _, name := range names {
+		e := entries[name]
+		response = append(response, &poolResponse{PoolIdentity: &e.pool.V4ID, Providers: e.providers})
+	}
+	respJSON, _ := json.Marshal(response)
+	sum := sha256.Sum256(respJSON)
+	version := hex.EncodeToString(sum[:8])
+	modified := now.UTC().Truncate(time.Second)
+	if version == r.version {
+		modified = r.modified
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.entries = entries
+	r.lastRefresh = now
+	r.response = response
+	r.version = version
+	r.modified = modified
+	r.nextRefresh = now.Add(time.Duration(r.refreshInterval) * time.Second)
+	log.Printf("[POOLS] refresh complete; %d pools registered, version %s", len(r.entries), version)
+}
+
+// getPoolResponses returns the pools and their providers along with the version, last modified
+// time and next scheduled refresh of the response
+func (r *poolRegistry) getPoolResponses() ([]*poolResponse, string, time.Time, time.Time) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.response, r.version, r.modified, r.nextRefresh
+}
+
+// getPools returns the identified pools sorted by sequence
+func (r *poolRegistry) getPools() []*pool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	pools := make([]*pool, 0, len(r.entries))
+	for _, e := range r.entries {
+		if e.pool != nil {
+			pools = append(pools, e.pool)
+		}
+	}
+
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].Sequence < pools[j].Sequence
+	})
+
+	return pools
+}
+
+// getStatus returns refresh details for every registered pool source
+func (r *poolRegistry) getStatus() []poolStatus {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	out := make([]poolStatus, 0, len(r.entries))
+	for name, e := range r.entries {
+		status := poolStatus{ID: name, Checked: e.checked, Refreshed: e.refreshed, LastError: e.lastError}
+		if e.pool != nil {
+			status.Name = e.pool.V4ID.Name
+			status.Sequence = e.pool.Sequence
+		}
+		status.Stale = e.refreshed.Before(r.lastRefresh)
+		out = append(out, status)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Sequence < out[j].Sequence
+	})
+
+	return out
+}
+
+// GetPoolRegistry returns the refresh status of all pools in the registry
+func (svc *ServiceContext) GetPoolRegistry(c *gin.Context) {
+	c.JSON(http.StatusOK, svc.Pools.getStatus())
+}
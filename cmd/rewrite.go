@@ -0,0 +1,327 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/uvalib/virgo4-api/v4api"
+	"github.com/uvalib/virgo4-parser/v4parser"
+)
+
+// kinds of query rewrite
+const (
+	rewriteRule     = "rule"
+	rewriteStopword = "stopword"
+	rewriteSynonym  = "synonym"
+	rewriteSpelling = "spelling"
+)
+
+// this is a struct that mirrors the V4DB query_rewrites table. The kind of rewrite sets how
+// match and replace are used:
+//   - rule: match is a case insensitive regular expression for the terms of a clause; the clause
+//     is replaced with replace, which may use $1 style references and change the clause field
+//   - stopword: match is a word that is dropped from clauses
+//   - synonym: match is a term that is expanded with the comma separated synonyms in replace
+//   - spelling: match is a misspelled word; replace is suggested in its place
+//
+// Rewrites with a field only apply to clauses for that field. The others apply to the text fields
+type queryRewrite struct {
+	ID      int
+	Kind    string
+	Field   string
+	Match   string
+	Replace string
+	Enabled bool
+}
+
+// textFields are the query fields that rewrites without a field apply to
+var textFields = []string{"keyword", "title", "journal_title", "subject", "fulltext", "series"}
+
+var clauseRE = regexp.MustCompile(`([a-z_]+)\s*:\s*\{([^{}]*)\}`)
+var termRE = regexp.MustCompile(`"[^"]*"|[()]|[^\s()"]+`)
+
+// queryClause is a single field:{terms} clause of a query
+type queryClause struct {
+	Field string
+	Terms string
+}
+
+// queryRewriteStage is one step of the query rewrite pipeline. Each stage rewrites a single
+// clause and returns true if it changed it. Stages run in order
+type queryRewriteStage struct {
+	Name    string
+	Rewrite func(clause *queryClause, rules *rewriteRules) bool
+}
+
+var queryRewriteStages = []queryRewriteStage{
+	{Name: rewriteRule, Rewrite: applyRewriteRules},
+	{Name: rewriteStopword, Rewrite: removeStopwords},
+	{Name: rewriteSynonym, Rewrite: expandSynonyms},
+}
+
+// queryRewriteResult reports how a search query was rewritten before it was sent to the pools
+type queryRewriteResult struct {
+	Original  string   `json:"original"`
+	Rewritten string   `json:"rewritten"`
+	Applied   []string `json:"applied"`
+}
+
+type compiledRule struct {
+	field   string
+	pattern *regexp.Regexp
+	replace string
+}
+
+// rewriteRules are the enabled query rewrites, indexed by field ("" for the text fields)
+type rewriteRules struct {
+	rules     []compiledRule
+	stopwords map[string]map[string]bool
+	synonyms  map[string]map[string][]string
+	spellings map[string]map[string]string
+}
+
+// queryRewriter holds the current query rewrite rules and refreshes them from the V4 DB
+type queryRewriter struct {
+	svc             *ServiceContext
+	refreshInterval int
+	rules           atomic.Pointer[rewriteRules]
+}
+
+func newQueryRewriter(svc *ServiceContext, interval int) *queryRewriter {
+	qr := queryRewriter{svc: svc, refreshInterval: interval}
+	qr.rules.Store(newRewriteRules(nil))
+
+	go qr.monitorRewrites()
+
+	return &qr
+}
+
+func (qr *queryRewriter) monitorRewrites() {
+	for {
+		qr.refreshRules()
+		log.Printf("[REWRITE] refresh scheduled in %d seconds", qr.refreshInterval)
+		time.Sleep(time.Duration(qr.refreshInterval) * time.Second)
+	}
+}
+
+// refreshRules reads the enabled query rewrites. If they can't be read the current rules are kept
+func (qr *queryRewriter) refreshRules() {
+	var rewrites []*queryRewrite
+	dbResp := qr.svc.GDB.Where("enabled=?", true).Order("id asc").Find(&rewrites)
+	if dbResp.Error != nil {
+		log.Printf("[REWRITE] WARNING: Unable to get query rewrites: %s", dbResp.Error.Error())
+		return
+	}
+	qr.rules.Store(newRewriteRules(rewrites))
+	log.Printf("[REWRITE] loaded %d query rewrites", len(rewrites))
+}
+
+func newRewriteRules(rewrites []*queryRewrite) *rewriteRules {
+	rules := rewriteRules{stopwords: make(map[string]map[string]bool),
+		synonyms: make(map[string]map[string][]string), spellings: make(map[string]map[string]string)}
+	for _, rw := range rewrites {
+		match := strings.ToLower(strings.TrimSpace(rw.Match))
+		switch rw.Kind {
+		case rewriteRule:
+			re, err := regexp.Compile("(?i)" + rw.Match)
+			if err != nil {
+				log.Printf("[REWRITE] ERROR: invalid rule %d pattern [%s]: %s", rw.ID, rw.Match, err.Error())
+				continue
+			}
+			rules.rules = append(rules.rules, compiledRule{field: rw.Field, pattern: re, replace: rw.Replace})
+		case rewriteStopword:
+			if rules.stopwords[rw.Field] == nil {
+				rules.stopwords[rw.Field] = make(map[string]bool)
+			}
+			rules.stopwords[rw.Field][match] = true
+		case rewriteSynonym:
+			if rules.synonyms[rw.Field] == nil {
+				rules.synonyms[rw.Field] = make(map[string][]string)
+			}
+			rules.synonyms[rw.Field][match] = append(rules.synonyms[rw.Field][match], splitList(rw.Replace)...)
+		case rewriteSpelling:
+			if rules.spellings[rw.Field] == nil {
+				rules.spellings[rw.Field] = make(map[string]string)
+			}
+			rules.spellings[rw.Field][match] = strings.TrimSpace(rw.Replace)
+		default:
+			log.Printf("[REWRITE] ERROR: query rewrite %d has unknown kind [%s]", rw.ID, rw.Kind)
+		}
+	}
+	return &rules
+}
+
+// appliesTo returns true if a rewrite for the rule field applies to a clause field
+func appliesTo(ruleField string, field string) bool {
+	if ruleField == "" {
+		return slices.Contains(textFields, field)
+	}
+	return ruleField == field
+}
+
+// lookup returns the value for a key from the rewrites for the field or the text fields
+func lookup[T any](byField map[string]map[string]T, field string, key string) (T, bool) {
+	if val, ok := byField[field][key]; ok {
+		return val, true
+	}
+	if slices.Contains(textFields, field) {
+		val, ok := byField[""][key]
+		return val, ok
+	}
+	var none T
+	return none, false
+}
+
+// isWord returns true if a clause term is a plain word; not a phrase, operator or parenthesis
+func isWord(term string) bool {
+	switch term {
+	case "AND", "OR", "NOT", "(", ")":
+		return false
+	}
+	return strings.HasPrefix(term, "\"") == false
+}
+
+// rewrite runs the query through the rewrite pipeline. It returns the rewrite result along
+// with spelling suggestions for the original query. If the rewritten query is not valid, the
+// original query is used
+func (qr *queryRewriter) rewrite(query string) (*queryRewriteResult, []v4api.Suggestion) {
+	rules := qr.rules.Load()
+	out := queryRewriteResult{Original: query, Rewritten: query, Applied: make([]string, 0)}
+
+	applied := make([]string, 0)
+	rewritten := clauseRE.ReplaceAllStringFunc(query, func(match string) string {
+		parts := clauseRE.FindStringSubmatch(match)
+		clause := queryClause{Field: parts[1], Terms: parts[2]}
+		changed := false
+		for _, stage := range queryRewriteStages {
+			if stage.Rewrite(&clause, rules) {
+				changed = true
+				if slices.Contains(applied, stage.Name) == false {
+					applied = append(applied, stage.Name)
+				}
+			}
+		}
+		if changed == false {
+			return match
+		}
+		return fmt.Sprintf("%s: {%s}", clause.Field, clause.Terms)
+	})
+
+	if rewritten != query {
+		if valid, errors := v4parser.Validate(rewritten); valid == false {
+			log.Printf("WARNING: rewrite of [%s] to [%s] is not valid; using the original query: %s", query, rewritten, errors)
+		} else {
+			log.Printf("INFO: rewrote [%s] to [%s] with %v", query, rewritten, applied)
+			out.Rewritten = rewritten
+			out.Applied = applied
+		}
+	}
+
+	suggestions := make([]v4api.Suggestion, 0)
+	if corrected := correctSpelling(query, rules); corrected != query {
+		suggestions = append(suggestions, v4api.Suggestion{Type: rewriteSpelling, Value: corrected, Reason: "possible misspelling"})
+	}
+	return &out, suggestions
+}
+
+// applyRewriteRules replaces the clause using the first rule that matches its terms
+func applyRewriteRules(clause *queryClause, rules *rewriteRules) bool {
+	terms := strings.TrimSpace(clause.Terms)
+	for _, rule := range rules.rules {
+		if appliesTo(rule.field, clause.Field) == false {
+			continue
+		}
+		idx := rule.pattern.FindStringSubmatchIndex(terms)
+		if idx == nil {
+			continue
+		}
+		replaced := string(rule.pattern.ExpandString(nil, rule.replace, terms, idx))
+		if parts := clauseRE.FindStringSubmatch(replaced); parts != nil && parts[0] == strings.TrimSpace(replaced) {
+			clause.Field = parts[1]
+			clause.Terms = parts[2]
+		} else {
+			clause.Terms = replaced
+		}
+		return true
+	}
+	return false
+}
+
+// removeStopwords drops stopwords from clauses that are a simple list of words and phrases.
+// Clauses with operators are left alone, as are clauses that are only stopwords
+func removeStopwords(clause *queryClause, rules *rewriteRules) bool {
+	terms := termRE.FindAllString(clause.Terms, -1)
+	kept := make([]string, 0, len(terms))
+	for _, term := range terms {
+		switch term {
+		case "AND", "OR", "NOT", "(", ")":
+			return false
+		}
+		if isWord(term) {
+			if _, stop := lookup(rules.stopwords, clause.Field, strings.ToLower(term)); stop {
+				continue
+			}
+		}
+		kept = append(kept, term)
+	}
+	if len(kept) == len(terms) || len(kept) == 0 {
+		return false
+	}
+	clause.Terms = strings.Join(kept, " ")
+	return true
+}
+
+// expandSynonyms replaces words that have synonyms with a group of the word or its synonyms
+func expandSynonyms(clause *queryClause, rules *rewriteRules) bool {
+	terms := termRE.FindAllString(clause.Terms, -1)
+	changed := false
+	for i, term := range terms {
+		if isWord(term) == false {
+			continue
+		}
+		synonyms, ok := lookup(rules.synonyms, clause.Field, strings.ToLower(term))
+		if ok == false || len(synonyms) == 0 {
+			continue
+		}
+		group := []string{term}
+		for _, syn := range synonyms {
+			if strings.Contains(syn, " ") {
+				syn = fmt.Sprintf("\"%s\"", syn)
+			}
+			group = append(group, syn)
+		}
+		terms[i] = fmt.Sprintf("( %s )", strings.Join(group, " OR "))
+		changed = true
+	}
+	if changed {
+		clause.Terms = strings.Join(terms, " ")
+	}
+	return changed
+}
+
+// correctSpelling returns the query with any misspelled words replaced
+func correctSpelling(query string, rules *rewriteRules) string {
+	return clauseRE.ReplaceAllStringFunc(query, func(match string) string {
+		parts := clauseRE.FindStringSubmatch(match)
+		terms := termRE.FindAllString(parts[2], -1)
+		changed := false
+		for i, term := range terms {
+			if isWord(term) == false {
+				continue
+			}
+			if correction, ok := lookup(rules.spellings, parts[1], strings.ToLower(term)); ok {
+				terms[i] = correction
+				changed = true
+			}
+		}
+		if changed == false {
+			return match
+		}
+		return fmt.Sprintf("%s: {%s}", parts[1], strings.Join(terms, " "))
+	})
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -16,25 +18,37 @@ import (
 // Search queries all pools for results, collects and curates results. Response is JSON
 func (svc *ServiceContext) Search(c *gin.Context) {
 	var req clientSearchRequest
-	if jsonErr := c.BindJSON(&req); jsonErr != nil {
-		log.Printf("ERROR: Unable to parse search request: %s", jsonErr.Error())
-		err := searchError{Message: "This query is malformed or unsupported.", Details: jsonErr.Error()}
+	if bindSearchRequest(c, &req) == false {
+		return
+	}
+
+	if req.Pagination.Start < 0 || req.Pagination.Rows < 0 {
+		log.Printf("INFO: Query [%s] has invalid pagination: %+v", req.Query, req.Pagination)
+		err := searchError{Message: "This query is malformed or unsupported.",
+			Details: "pagination start and rows must not be negative"}
 		c.JSON(http.StatusBadRequest, err)
 		return
 	}
 
-	valid, errors := v4parser.Validate(req.Query)
-	if valid == false {
-		log.Printf("INFO: Query [%s] is not valid: %s", req.Query, errors)
-		err := searchError{Message: "This query is malformed or unsupported.", Details: errors}
+	if req.Blended && req.Pagination.Start+req.Pagination.Rows > maxBlendedDepth {
+		log.Printf("INFO: Blended query [%s] pagination too deep: %+v", req.Query, req.Pagination)
+		err := searchError{Message: "This query is malformed or unsupported.",
+			Details: fmt.Sprintf("blended results are limited to the first %d hits", maxBlendedDepth)}
 		c.JSON(http.StatusBadRequest, err)
 		return
 	}
 
+	filters := svc.FilterCache.getSnapshot()
+	if status, err := checkGlobalFilters(&req, filters); err != nil {
+		log.Printf("INFO: Query [%s] has global filters that can't be applied: %s", req.Query, err.Details)
+		c.JSON(status, err)
+		return
+	}
+
 	// Pools have already been placed in request context by poolsMiddleware. Get them or fail
 	pools := getPoolsFromContext(c)
 	if len(pools) == 0 {
-		err := searchError{Message: "All resourcess are surrently offline. Please try again later.", Details: errors}
+		err := searchError{Message: "All resourcess are surrently offline. Please try again later."}
 		c.JSON(http.StatusInternalServerError, err)
 		return
 	}
@@ -47,20 +61,33 @@ func (svc *ServiceContext) Search(c *gin.Context) {
 
 
 
-	// Do the search...
+	// Do the search... pool requests are cancelled if the client goes away or the
+	// overall search deadline passes
+	ctx, cancel := context.WithTimeout(c.Request.Context(), svc.SearchTimeout)
+	defer cancel()
 	out := NewSearchResponse(&req)
 	start := time.Now()
-	channel := make(chan *v4api.PoolResult)
-	outstandingRequests := 0
+
+	// the pools are searched with the rewritten query; the response keeps the original request
+	searchReq := req
+	out.Rewrite = &queryRewriteResult{Original: req.Query, Rewritten: req.Query, Applied: make([]string, 0)}
+	if req.NoRewrite == false {
+		out.Rewrite, out.Suggestions = svc.Rewriter.rewrite(req.Query)
+		searchReq.Query = out.Rewrite.Rewritten
+	}
 	for _, p := range pools {
 		out.Pools = append(out.Pools, p.V4ID)
-		outstandingRequests++
-		go svc.searchPool(p, req, headers, channel)
 	}
 
-	// wait for all to be done and get respnses as they come in
-	for outstandingRequests > 0 {
-		poolResponse := <-channel
+	// get responses as they come in. pools that have not answered by the deadline are not collected
+	collected := fanOut(ctx, "search", len(pools), func(ctx context.Context, idx int) *v4api.PoolResult {
+		return svc.searchPool(ctx, pools[idx], searchReq, filters, headers)
+	}, func(idx int, err error) *v4api.PoolResult {
+		results := NewPoolResult(pools[idx], 0)
+		results.StatusCode = http.StatusInternalServerError
+		results.StatusMessage = fmt.Sprintf("%s search failed", pools[idx].V4ID.Name)
+		return results
+	}, func(idx int, poolResponse *v4api.PoolResult) {
 		out.Results = append(out.Results, poolResponse)
 
 		log.Printf("Pool %s has %d hits and status %d [%s]", poolResponse.ServiceURL,
@@ -81,7 +108,25 @@ func (svc *ServiceContext) Search(c *gin.Context) {
 				poolResponse.StatusCode, poolResponse.StatusMessage)
 			out.Warnings = append(out.Warnings, poolResponse.StatusMessage)
 		}
-		outstandingRequests--
+	})
+
+	if c.Request.Context().Err() != nil {
+		log.Printf("INFO: search [%s] abandoned by client after %d ms", req.Query, int64(time.Since(start)/time.Millisecond))
+		c.Abort()
+		return
+	}
+
+	// any pools that have not answered by the deadline are reported as timed out
+	for idx, p := range pools {
+		if collected[idx] {
+			continue
+		}
+		log.Printf("WARNING: %s did not respond within the %s search deadline", p.V4ID.ID, svc.SearchTimeout)
+		results := NewPoolResult(p, int64(time.Since(start)/time.Millisecond))
+		results.StatusCode = http.StatusRequestTimeout
+		results.StatusMessage = fmt.Sprintf("%s did not respond in time", p.V4ID.Name)
+		out.Results = append(out.Results, results)
+		out.Warnings = append(out.Warnings, results.StatusMessage)
 	}
 
 	// sort pool results by pool sequence
@@ -91,6 +136,15 @@ func (svc *ServiceContext) Search(c *gin.Context) {
 	poolSort := bySequence{results: out.Results, pools: pools}
 	sort.Sort(&poolSort)
 
+	if req.Blended {
+		// the blended list contains all of the hits, so drop them from the per-pool results
+		log.Printf("Blend results from all pools")
+		out.Blended = blendResults(&req, out.Results, pools)
+		for _, pr := range out.Results {
+			pr.Groups = nil
+		}
+	}
+
 	// Total time for all respones (basically the longest response)
 	elapsed := time.Since(start)
 	elapsedMS := int64(elapsed / time.Millisecond)
@@ -100,15 +154,38 @@ func (svc *ServiceContext) Search(c *gin.Context) {
 	c.JSON(http.StatusOK, out)
 }
 
-// Goroutine to do a pool search and return the PoolResults on the channel
-func (svc *ServiceContext) searchPool(pool *pool, req clientSearchRequest, headers map[string]string, channel chan *v4api.PoolResult) {
+// bindSearchRequest parses and validates a search request. If it is not valid, a 400
+// response has been sent and false is returned
+func bindSearchRequest(c *gin.Context, req *clientSearchRequest) bool {
+	if jsonErr := c.BindJSON(req); jsonErr != nil {
+		log.Printf("ERROR: Unable to parse search request: %s", jsonErr.Error())
+		err := searchError{Message: "This query is malformed or unsupported.", Details: jsonErr.Error()}
+		c.JSON(http.StatusBadRequest, err)
+		return false
+	}
+
+	valid, errors := v4parser.Validate(req.Query)
+	if valid == false {
+		log.Printf("INFO: Query [%s] is not valid: %s", req.Query, errors)
+		err := searchError{Message: "This query is malformed or unsupported.", Details: errors}
+		c.JSON(http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+// searchPool does a pool search and returns the PoolResults. Global filters are applied with
+// the filter snapshot they were checked against
+func (svc *ServiceContext) searchPool(ctx context.Context, pool *pool, req clientSearchRequest, filters *filterSnapshot, headers map[string]string) *v4api.PoolResult {
 	// Master search always uses the Private URL to communicate with pools
 	// NOTE: Sending the debug QP to get max_score info from each pool
 	sURL := fmt.Sprintf("%s/api/search?debug=1", pool.PrivateURL)
 
 	// only send filter group applicable to this pool (if any)
 	poolReq := req
-	poolReq.Filters = []v4api.Filter{}
+	poolReq.Filters = poolFilters(&req, pool, filters)
+	poolReq.GlobalFilters = nil
+	poolReq.NoRewrite = false
 
 	log.Printf("INFO: lookup starting sort order for %s", pool.V4ID.ID)
 	poolReq.Sort = v4api.SortOrder{SortID: "SortRelevance", Order: "desc"}
@@ -119,12 +196,6 @@ func (svc *ServiceContext) searchPool(pool *pool, req clientSearchRequest, heade
 		}
 	}
 
-	for _, filterGroup := range req.Filters {
-		if filterGroup.PoolID == pool.V4ID.ID {
-			poolReq.Filters = append(poolReq.Filters, filterGroup)
-			break
-		}
-	}
 	for _, poolSort := range req.PoolSort {
 		if poolSort.PoolID == pool.V4ID.ID {
 			poolReq.Sort = poolSort.Sort
@@ -132,32 +203,54 @@ func (svc *ServiceContext) searchPool(pool *pool, req clientSearchRequest, heade
 		}
 	}
 
+	// blended results are merged by relevance, so every pool must return all hits up
+	// to the end of the requested page sorted by relevance
+	if req.Blended {
+		poolReq.Pagination = blendedPagination(&req)
+		poolReq.Sort = v4api.SortOrder{SortID: "SortRelevance", Order: "desc"}
+	}
+
 	reqBytes, _ := json.Marshal(poolReq)
 	httpClient := svc.HTTPClient
 	if pool.IsExternal {
 		log.Printf("Pool %s is managed externally, reduce timeout to 5 seconds", pool.V4ID.Name)
 		httpClient = svc.FastHTTPClient
 	}
-	postResp := serviceRequest("POST", sURL, reqBytes, headers, httpClient)
+	// global filters can't be applied to pools that don't support them, and searching
+	// those pools without the filters would return unfiltered results
+	if unsupported := unsupportedFilters(&req, pool, filters); len(unsupported) > 0 {
+		log.Printf("INFO: %s does not support filters %v; skipping search", pool.V4ID.ID, unsupported)
+		results := NewPoolResult(pool, 0)
+		results.StatusCode = http.StatusNotImplemented
+		results.StatusMessage = fmt.Sprintf("%s does not support the %s filter", pool.V4ID.Name, strings.Join(unsupported, ", "))
+		return results
+	}
+	if svc.Breakers.allow(pool.V4ID.ID) == false {
+		log.Printf("WARNING: circuit breaker for %s is open; skipping search", pool.V4ID.ID)
+		results := NewPoolResult(pool, 0)
+		results.StatusCode = http.StatusServiceUnavailable
+		results.StatusMessage = breakerMessage(pool)
+		return results
+	}
+	postResp := serviceRequest(ctx, "POST", sURL, reqBytes, headers, httpClient)
+	svc.Breakers.recordRequest(ctx, pool.V4ID.ID, postResp.StatusCode)
 	results := NewPoolResult(pool, postResp.ElapsedMS)
 	if postResp.StatusCode != http.StatusOK {
 		results.StatusCode = postResp.StatusCode
 		results.StatusMessage = string(postResp.Response)
-		channel <- results
-		return
+		return results
 	}
 
 	err := json.Unmarshal(postResp.Response, results)
 	if err != nil {
 		results.StatusCode = http.StatusInternalServerError
 		results.StatusMessage = "Malformed search response"
-		channel <- results
-		return
+		return results
 	}
 
 	// If we are this far, there is a valid response. Add language
 	results.StatusCode = http.StatusOK
 	results.ElapsedMS = postResp.ElapsedMS
 
-	channel <- results
+	return results
 }
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -23,11 +25,20 @@ type ServiceContext struct {
 	Version        string
 	GDB            *gorm.DB
 	JWTKey         string
+	UIURL          string
 	Solr           SolrConfig
 	HTTPClient     *http.Client
 	FastHTTPClient *http.Client
 	SlowHTTPClient *http.Client
 	FilterCache    *filterCache
+	Rewriter       *queryRewriter
+	Pools          *poolRegistry
+	Breakers       *breakerSet
+	Health         HealthConfig
+	Fonts          *fontChain
+	Jobs           *jobStore
+	Details        *detailLimiter
+	SearchTimeout  time.Duration
 }
 
 // InitializeService will initialize the service context based on the config parameters.
@@ -36,8 +47,11 @@ type ServiceContext struct {
 func InitializeService(version string, cfg *ServiceConfig) *ServiceContext {
 	log.Printf("Initializing Service")
 	svc := ServiceContext{Version: version,
-		Solr:   cfg.Solr,
-		JWTKey: cfg.JWTKey}
+		Solr:          cfg.Solr,
+		Health:        cfg.Health,
+		UIURL:         cfg.UIURL,
+		SearchTimeout: time.Duration(cfg.SearchTimeout) * time.Second,
+		JWTKey:        cfg.JWTKey}
 
 	log.Printf("Connect to Postgres")
 	connStr := fmt.Sprintf("user=%s password=%s dbname=%s host=%s port=%d",
@@ -71,9 +85,33 @@ func InitializeService(version string, cfg *ServiceConfig) *ServiceContext {
 		Timeout:   30 * time.Second,
 	}
 
+	log.Printf("Load PDF fonts")
+	svc.Fonts, err = loadFontChain(cfg.PDF.FontDirs, cfg.PDF.Fonts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Init export jobs")
+	svc.Jobs, err = newJobStore(&svc, cfg.JobRetention)
+	if err != nil {
+		log.Printf("ERROR: Unable to init export jobs; async exports are disabled: %s", err.Error())
+		svc.Jobs = nil
+	}
+
+	svc.Details = newDetailLimiter(cfg.Details)
+
+	log.Printf("Init pool circuit breakers")
+	svc.Breakers = newBreakerSet(5, 30)
+
+	log.Printf("Init pool registry")
+	svc.Pools = newPoolRegistry(&svc, 60)
+
 	log.Printf("Init filter cache")
 	svc.FilterCache = newFilterCache(&svc, 300)
 
+	log.Printf("Init query rewriter")
+	svc.Rewriter = newQueryRewriter(&svc, 300)
+
 	return &svc
 }
 
@@ -96,26 +134,6 @@ func (svc *ServiceContext) GetVersion(c *gin.Context) {
 	c.JSON(http.StatusOK, vMap)
 }
 
-// HealthCheck reports the health of the serivce
-func (svc *ServiceContext) HealthCheck(c *gin.Context) {
-	type hcResp struct {
-		Healthy bool   `json:"healthy"`
-		Message string `json:"message,omitempty"`
-	}
-	hcMap := make(map[string]hcResp)
-
-	var total int64
-	dbResp := svc.GDB.Table("sources").Count(&total)
-	if dbResp.Error != nil {
-		log.Printf("ERROR: Failed response from PSQL healthcheck: %s", dbResp.Error.Error())
-		hcMap["postgres"] = hcResp{Healthy: false, Message: dbResp.Error.Error()}
-	} else {
-	hcMap["postgres"] = hcResp{Healthy: true}
-	}
-
-	c.JSON(http.StatusOK, hcMap)
-}
-
 // getBearerToken is a helper to extract the user auth token from the Auth header
 func getBearerToken(authorization string) (string, error) {
 	components := strings.Split(strings.Join(strings.Fields(authorization), " "), " ")
@@ -184,13 +202,13 @@ type timedResponse struct {
 	ElapsedMS  int64
 }
 
-func serviceRequest(verb string, url string, body []byte, headers map[string]string, httpClient *http.Client) timedResponse {
+func serviceRequest(ctx context.Context, verb string, url string, body []byte, headers map[string]string, httpClient *http.Client) timedResponse {
 	log.Printf("%s %s: %s timeout %.0f", verb, url, body, httpClient.Timeout.Seconds())
 	var postReq *http.Request
 	if verb == "POST" {
-		postReq, _ = http.NewRequest(verb, url, bytes.NewBuffer(body))
+		postReq, _ = http.NewRequestWithContext(ctx, verb, url, bytes.NewBuffer(body))
 	} else {
-		postReq, _ = http.NewRequest(verb, url, nil)
+		postReq, _ = http.NewRequestWithContext(ctx, verb, url, nil)
 	}
 
 	for name, val := range headers {
@@ -210,7 +228,7 @@ func serviceRequest(verb string, url string, body []byte, headers map[string]str
 		// This ensures the log filters pick up real errors
 		// Also pool timeouts are considered warnings cos we are adding a special filter
 		// to track them independently
-		if err.StatusCode == http.StatusNotImplemented || err.StatusCode == http.StatusRequestTimeout {
+		if err.StatusCode == http.StatusNotImplemented || err.StatusCode == http.StatusRequestTimeout || err.StatusCode == statusClientClosed {
 			logLevel = "WARNING"
 		}
 		log.Printf("%s: Failed response from POST %s - %d:%s. Elapsed Time: %d (ms)",
@@ -226,17 +244,27 @@ func serviceRequest(verb string, url string, body []byte, headers map[string]str
 	return resp
 }
 
+// statusClientClosed is the (nginx) status used for requests that were cancelled because
+// the client went away before they completed
+const statusClientClosed = 499
+
 // RequestError contains http status code and message for a failed service request
 type RequestError struct {
 	StatusCode int
 	Message    string
 }
 
+// handleAPIResponse returns the body of a successful response, or the error for a failed one.
+// Requests that got no response (DNS failures, resets, TLS errors and the like) are reported
+// as a 502 so they count against the pool; error responses keep the pool's status code
 func handleAPIResponse(logURL string, resp *http.Response, err error) ([]byte, *RequestError) {
 	if err != nil {
-		status := http.StatusBadRequest
+		status := http.StatusBadGateway
 		errMsg := err.Error()
-		if strings.Contains(err.Error(), "Timeout") {
+		if errors.Is(err, context.Canceled) {
+			status = statusClientClosed
+			errMsg = fmt.Sprintf("%s request was cancelled", logURL)
+		} else if errors.Is(err, context.DeadlineExceeded) || strings.Contains(err.Error(), "Timeout") {
 			status = http.StatusRequestTimeout
 			errMsg = fmt.Sprintf("%s timed out", logURL)
 		} else if strings.Contains(err.Error(), "connection refused") {
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
 	"github.com/uvalib/virgo4-api/v4api"
 )
 
@@ -34,3 +39,119 @@ func (s *bySequence) Less(i, j int) bool {
 	}
 	return a.Sequence < b.Sequence
 }
+
+// itemSorts are the supported server-side sort orders for exported items
+var itemSorts = map[string]func(a, b *itemDetail) int{
+	"call_number": func(a, b *itemDetail) int {
+		return compareCallNumbers(firstValue(a.CallNumber), firstValue(b.CallNumber))
+	},
+	"location": func(a, b *itemDetail) int {
+		if cmp := compareText(firstValue(a.Library), firstValue(b.Library)); cmp != 0 {
+			return cmp
+		}
+		if cmp := compareText(firstValue(a.Location), firstValue(b.Location)); cmp != 0 {
+			return cmp
+		}
+		return compareCallNumbers(firstValue(a.CallNumber), firstValue(b.CallNumber))
+	},
+	"title": func(a, b *itemDetail) int {
+		return compareText(firstValue(a.Title), firstValue(b.Title))
+	},
+	"author": func(a, b *itemDetail) int {
+		return compareText(firstValue(a.Author), firstValue(b.Author))
+	},
+}
+
+// byRequestOrder sorts item details into the order they were submitted
+func byRequestOrder(items []*itemDetail) {
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Index < items[j].Index
+	})
+}
+
+// sortItems sorts item details by the named sort. Items that compare equal keep request order
+func sortItems(items []*itemDetail, sortName string) {
+	byRequestOrder(items)
+	cmp, ok := itemSorts[sortName]
+	if !ok {
+		return
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return cmp(items[i], items[j]) < 0
+	})
+}
+
+func firstValue(vals []string) string {
+	if len(vals) == 0 {
+		return ""
+	}
+	return vals[0]
+}
+
+// compareText does a case insensitive comparison. Empty values sort last
+func compareText(a, b string) int {
+	if a == "" || b == "" {
+		return emptyLast(a, b)
+	}
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+}
+
+// compareCallNumbers compares call numbers so that the numeric parts sort numerically
+// (QA76.9 before QA100). Empty values sort last
+func compareCallNumbers(a, b string) int {
+	if a == "" || b == "" {
+		return emptyLast(a, b)
+	}
+	aParts := callNumberParts(a)
+	bParts := callNumberParts(b)
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		aNum, aErr := strconv.ParseFloat(aParts[i], 64)
+		bNum, bErr := strconv.ParseFloat(bParts[i], 64)
+		if aErr == nil && bErr == nil {
+			if aNum != bNum {
+				if aNum < bNum {
+					return -1
+				}
+				return 1
+			}
+			continue
+		}
+		if cmp := strings.Compare(strings.ToUpper(aParts[i]), strings.ToUpper(bParts[i])); cmp != 0 {
+			return cmp
+		}
+	}
+	return len(aParts) - len(bParts)
+}
+
+var callNumberRegex = regexp.MustCompile(`[A-Za-z]+|\d+(\.\d+)?`)
+
+// callNumberParts splits a call number into alternating alpha and numeric runs. Numbers in
+// cutters (the .J38 in QA76.73 .J38) are decimals, so they are returned as fractions
+func callNumberParts(callNumber string) []string {
+	locs := callNumberRegex.FindAllStringIndex(callNumber, -1)
+	parts := make([]string, 0, len(locs))
+	for i, loc := range locs {
+		part := callNumber[loc[0]:loc[1]]
+		if i > 0 && part[0] >= '0' && part[0] <= '9' {
+			prev := locs[i-1]
+			isCutter := prev[1] == loc[0] && prev[0] > 0 && callNumber[prev[0]-1] == '.'
+			if isCutter && strings.Contains(part, ".") == false {
+				part = "0." + part
+			}
+		}
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+func emptyLast(a, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return 1
+	case b == "":
+		return -1
+	}
+	return 0
+}